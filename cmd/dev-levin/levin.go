@@ -3,12 +3,22 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/SMemsky/go-flakechain/net/levin"
+	"github.com/SMemsky/go-flakechain/net/p2p"
+	"github.com/SMemsky/go-flakechain/storages/portable"
 )
 
 func main() {
-	conn, err := levin.Dial("188.35.187.49:12560")
+	router := levin.NewRouter()
+	router.Handle(1007, p2p.SupportedFlagsRequest{},
+		func(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+			fmt.Printf("1007: %+v\n", request)
+			return &p2p.SupportedFlagsResponse{}, 0
+		})
+
+	conn, err := levin.Dial("188.35.187.49:12560", router)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -16,17 +26,17 @@ func main() {
 	defer conn.Close()
 
 	packet, _ := hex.DecodeString("01110101010102010108096e6f64655f646174610c100a6c6f63616c5f74696d65051f0f985b00000000076d795f706f727406103100000a6e6574776f726b5f69640a40726e6f77666c616b656e6574776f726b07706565725f696405a1a96dd8d586a7ee0c7061796c6f61645f646174610c101563756d756c61746976655f646966666963756c747905f434072ca80000000e63757272656e745f68656967687405106001000000000006746f705f69640a803baf40bb523e23f437c0b986abd208dca407eb5c46608e51087ec15e995af6ab0b746f705f76657273696f6e0801")
-	if err := conn.Invoke(1001, packet); err != nil {
+	request := &p2p.HandshakeRequest{}
+	if err := portable.Unmarshal(packet, request); err != nil {
 		fmt.Println(err)
+		return
 	}
 
-	for {
-		data, head, err := conn.Receive()
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
-
-		fmt.Printf("%+v\n%x\n", head, data)
+	response := &p2p.HandshakeResponse{}
+	code, err := conn.Invoke(1001, request, response, time.Minute)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	fmt.Printf("1001: %d\n%+v\n", code, response)
 }
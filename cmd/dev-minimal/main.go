@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -14,9 +15,10 @@ const (
 func main() {
 	defer log.Println("Ok, here comes da end")
 
-	foo, err := p2p.StartNode(p2pNodeIncomingPort)
+	foo, err := p2p.StartNode(context.Background(), p2p.Config{Port: p2pNodeIncomingPort})
 	if err != nil {
 		log.Println(err)
+		return
 	}
 	defer foo.Stop()
 
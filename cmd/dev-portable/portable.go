@@ -20,10 +20,10 @@ type BasicNodeData struct {
 }
 
 type CoreSyncData struct {
-	CumulativeDifficulty uint64 `store:"cumulative_difficulty"`
-	CurrentHeight        uint64 `store:"current_height"`
-	TopId                string `store:"top_id"`
-	TopVersion           uint8  `store:"top_version"`
+	CumulativeDifficulty uint64   `store:"cumulative_difficulty"`
+	CurrentHeight        uint64   `store:"current_height"`
+	TopId                [32]byte `store:"top_id"`
+	TopVersion           uint8    `store:"top_version"`
 }
 
 type CommandHandshakeResponse struct {
@@ -48,6 +48,9 @@ type AddressType struct {
 }
 
 func testBasic() {
+	var topId [32]byte
+	hex.Decode(topId[:], []byte("3baf40bb523e23f437c0b986abd208dca407eb5c46608e51087ec15e995af6ab"))
+
 	test := CommandHandshakeRequest{
 		BasicNodeData{
 			1536691999,
@@ -58,7 +61,7 @@ func testBasic() {
 		CoreSyncData{
 			722293175540,
 			90128,
-			";\xaf@\xbbR>#\xf47\xc0\xb9\x86\xab\xd2\x08\xdc\xa4\x07\xeb\\F`\x8eQ\x08~\xc1^\x99Z\xf6\xab",
+			topId,
 			1,
 		},
 	}
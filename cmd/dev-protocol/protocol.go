@@ -1,10 +1,11 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/SMemsky/go-flakechain/net/levin"
-	"github.com/SMemsky/go-flakechain/storages/portable"
 )
 
 const (
@@ -33,10 +34,10 @@ type BasicNodeData struct {
 }
 
 type CoreSyncData struct {
-	CumulativeDifficulty uint64 `store:"cumulative_difficulty"`
-	CurrentHeight        uint64 `store:"current_height"`
-	TopId                string `store:"top_id"`
-	TopVersion           uint8  `store:"top_version"`
+	CumulativeDifficulty uint64   `store:"cumulative_difficulty"`
+	CurrentHeight        uint64   `store:"current_height"`
+	TopId                [32]byte `store:"top_id"`
+	TopVersion           uint8    `store:"top_version"`
 }
 
 type PeerListEntry struct {
@@ -62,7 +63,14 @@ type CommandSupportedFlagsResponse struct {
 }
 
 func main() {
-	conn, err := levin.Dial("188.35.187.49:12560")
+	router := levin.NewRouter()
+	router.Handle(commandSupportedFlagsId, CommandSupportedFlagsRequest{},
+		func(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+			fmt.Println("1007: Request received")
+			return &CommandSupportedFlagsResponse{0}, levin.ReturnOK
+		})
+
+	conn, err := levin.Dial("188.35.187.49:12560", router)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -70,6 +78,8 @@ func main() {
 	defer conn.Close()
 
 	// Old values from one of original daemon runs (dumped via Wireshark)
+	var topId [32]byte
+	hex.Decode(topId[:], []byte("3baf40bb523e23f437c0b986abd208dca407eb5c46608e51087ec15e995af6ab"))
 	handshake := CommandHandshakeRequest{
 		BasicNodeData{
 			1536691999,
@@ -80,56 +90,17 @@ func main() {
 		CoreSyncData{
 			722293175540,
 			90128,
-			";\xaf@\xbbR>#\xf47\xc0\xb9\x86\xab\xd2\x08\xdc\xa4\x07\xeb\\F`\x8eQ\x08~\xc1^\x99Z\xf6\xab",
+			topId,
 			1,
 		},
 	}
 
-	rawHandshake, err := portable.Marshal(handshake)
+	response := &CommandHandshakeResponse{}
+	code, err := conn.Invoke(commandHandshakeId, handshake, response, time.Minute)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	if err := conn.Invoke(commandHandshakeId, rawHandshake); err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	for {
-		data, head, err := conn.Receive()
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
-
-		fmt.Printf("Received packet %d of size %d\n", head.Command, len(data))
-		fmt.Printf("%+v\n\n", head)
-
-		if head.Command == commandHandshakeId && head.Flags == levin.FlagResponse {
-			response := &CommandHandshakeResponse{}
-			if err := portable.Unmarshal(data, response); err != nil {
-				fmt.Println(err)
-				return
-			}
-			fmt.Println("1001: Response OK")
-		}
-		if head.Command == commandSupportedFlagsId && head.Flags == levin.FlagRequest {
-			request := &CommandSupportedFlagsRequest{}
-			if err := portable.Unmarshal(data, request); err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			response := &CommandSupportedFlagsResponse{0}
-			rawResponse, err := portable.Marshal(response)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			if err := conn.Respond(commandSupportedFlagsId, rawResponse); err != nil {
-				fmt.Println(err)
-				return
-			}
-		}
-	}
+	fmt.Printf("1001: Response OK, code %d\n", code)
+	fmt.Printf("%+v\n", response)
 }
@@ -0,0 +1,413 @@
+// portable-gen writes MarshalPortableObject and UnmarshalPortableObject
+// methods for every struct with `store` tags found in the given files, so they
+// are encoded straight to the output, without reflection or an intermediate
+// Section. It is meant to be run by go generate:
+//
+//	//go:generate go run ../../cmd/portable-gen -o portable_gen.go commands.go structs.go
+//
+// Supported field types are integers, float64, bool, string, []byte,
+// [N]byte, slices of those (but not slices of byte arrays) and named types.
+// Named types with generated or hand written object methods in the given
+// files are written directly, others are expected to implement
+// portable.Marshaler and portable.Unmarshaler. Slices of named types are
+// arrays of objects. The blob option is not supported and a struct may have
+// at most 64 stored fields
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type kind int
+
+const (
+	kindUint kind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindString
+	kindBytes     // []byte
+	kindByteArray // [N]byte
+	kindObject    // named type with portable methods
+)
+
+var basicKinds = map[string]struct {
+	kind kind
+	bits int
+}{
+	"uint64":  {kindUint, 64},
+	"uint32":  {kindUint, 32},
+	"uint16":  {kindUint, 16},
+	"uint8":   {kindUint, 8},
+	"byte":    {kindUint, 8},
+	"int64":   {kindInt, 64},
+	"int32":   {kindInt, 32},
+	"int16":   {kindInt, 16},
+	"int8":    {kindInt, 8},
+	"float64": {kindFloat, 0},
+	"bool":    {kindBool, 0},
+	"string":  {kindString, 0},
+}
+
+type field struct {
+	goName    string
+	name      string
+	optional  bool
+	omitEmpty bool
+
+	kind  kind
+	bits  int    // integer size
+	slice bool   // slice of kind
+	typ   string // Go type as written
+	elem  string // element type of slices
+}
+
+type structType struct {
+	name   string
+	fields []field
+}
+
+func main() {
+	output := flag.String("o", "portable_gen.go", "output file")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("portable-gen: no input files")
+	}
+
+	fset := token.NewFileSet()
+	packageName := ""
+	var types []structType
+	objects := make(map[string]bool)
+	for _, path := range flag.Args() {
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		packageName = file.Name.Name
+
+		found, err := collect(fset, file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		types = append(types, found...)
+		collectObjects(file, objects)
+	}
+
+	source, err := generate(packageName, types, objects)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns structs with stored fields in declaration order
+func collect(fset *token.FileSet, file *ast.File) ([]structType, error) {
+	var types []structType
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			st, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			fields, err := collectFields(st)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", fset.Position(typeSpec.Pos()), typeSpec.Name.Name, err)
+			}
+			if len(fields) > 64 {
+				return nil, fmt.Errorf("%s: %s: too many stored fields", fset.Position(typeSpec.Pos()), typeSpec.Name.Name)
+			}
+			if len(fields) != 0 {
+				types = append(types, structType{typeSpec.Name.Name, fields})
+			}
+		}
+	}
+	return types, nil
+}
+
+// Marks types with hand written MarshalPortableObject methods, so they are
+// written as objects like the generated ones
+func collectObjects(file *ast.File, objects map[string]bool) {
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv == nil || fn.Name.Name != "MarshalPortableObject" {
+			continue
+		}
+		recv := fn.Recv.List[0].Type
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+		}
+		if ident, ok := recv.(*ast.Ident); ok {
+			objects[ident.Name] = true
+		}
+	}
+}
+
+func collectFields(st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		if f.Tag == nil {
+			continue
+		}
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			return nil, err
+		}
+		store, ok := reflect.StructTag(tag).Lookup("store")
+		if !ok {
+			continue
+		}
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("embedded fields are not supported")
+		}
+
+		parts := strings.Split(store, ",")
+		template := field{name: parts[0]}
+		for _, option := range parts[1:] {
+			switch option {
+			case "optional":
+				template.optional = true
+			case "omitempty":
+				template.optional = true
+				template.omitEmpty = true
+			case "blob":
+				return nil, fmt.Errorf("%s: blob option is not supported", template.name)
+			}
+		}
+		if err := classify(&template, f.Type); err != nil {
+			return nil, fmt.Errorf("%s: %s", template.name, err)
+		}
+		if template.omitEmpty && template.kind == kindObject && !template.slice {
+			return nil, fmt.Errorf("%s: omitempty is not supported for objects", template.name)
+		}
+
+		for _, name := range f.Names {
+			f := template
+			f.goName = name.Name
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+func classify(f *field, expr ast.Expr) error {
+	f.typ = exprString(expr)
+	switch t := expr.(type) {
+	case *ast.Ident:
+		if basic, ok := basicKinds[t.Name]; ok {
+			f.kind, f.bits = basic.kind, basic.bits
+		} else {
+			f.kind = kindObject
+		}
+		return nil
+	case *ast.SelectorExpr:
+		f.kind = kindObject
+		return nil
+	case *ast.ArrayType:
+		elem := exprString(t.Elt)
+		if t.Len != nil {
+			if elem != "byte" && elem != "uint8" {
+				return fmt.Errorf("only byte arrays are supported")
+			}
+			f.kind = kindByteArray
+			return nil
+		}
+		if elem == "byte" || elem == "uint8" {
+			f.kind = kindBytes
+			return nil
+		}
+
+		f.slice = true
+		f.elem = elem
+		if basic, ok := basicKinds[elem]; ok {
+			f.kind, f.bits = basic.kind, basic.bits
+			return nil
+		}
+		switch t.Elt.(type) {
+		case *ast.Ident, *ast.SelectorExpr:
+			f.kind = kindObject
+			return nil
+		}
+	}
+	return fmt.Errorf("type %s is not supported", f.typ)
+}
+
+func exprString(expr ast.Expr) string {
+	var b bytes.Buffer
+	format.Node(&b, token.NewFileSet(), expr)
+	return b.String()
+}
+
+func generate(packageName string, types []structType, objects map[string]bool) ([]byte, error) {
+	for _, t := range types {
+		objects[t.name] = true
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by portable-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", packageName)
+	fmt.Fprintf(&b, "import \"github.com/SMemsky/go-flakechain/storages/portable\"\n")
+	for _, t := range types {
+		writeMarshal(&b, t, objects)
+		writeUnmarshal(&b, t, objects)
+	}
+
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s\n%s", err, b.Bytes())
+	}
+	return source, nil
+}
+
+// Methods of ObjectWriter and ObjectReader for the basic types
+var basicMethods = map[string]string{
+	"uint64":  "Uint64",
+	"uint32":  "Uint32",
+	"uint16":  "Uint16",
+	"uint8":   "Uint8",
+	"byte":    "Uint8",
+	"int64":   "Int64",
+	"int32":   "Int32",
+	"int16":   "Int16",
+	"int8":    "Int8",
+	"float64": "Float64",
+	"bool":    "Bool",
+	"string":  "String",
+}
+
+// Named types found in the input have generated or hand written object
+// methods. Others are expected to implement Marshaler and Unmarshaler
+func objectMethod(typ string, objects map[string]bool) string {
+	if objects[typ] {
+		return "Object"
+	}
+	return "Value"
+}
+
+func writeMarshal(b *bytes.Buffer, t structType, objects map[string]bool) {
+	fmt.Fprintf(b, "\nfunc (m *%s) MarshalPortableObject(w *portable.ObjectWriter) error {\n", t.name)
+
+	entries, omitted := 0, false
+	for _, f := range t.fields {
+		if f.omitEmpty {
+			omitted = true
+		} else {
+			entries++
+		}
+	}
+	if omitted {
+		fmt.Fprintf(b, "entries := %d\n", entries)
+		for _, f := range t.fields {
+			if f.omitEmpty {
+				fmt.Fprintf(b, "if %s {\nentries++\n}\n", nonEmpty(f, "m."+f.goName))
+			}
+		}
+		fmt.Fprintf(b, "w.Begin(entries)\n")
+	} else {
+		fmt.Fprintf(b, "w.Begin(%d)\n", entries)
+	}
+
+	for _, f := range t.fields {
+		value := "m." + f.goName
+		if f.omitEmpty {
+			fmt.Fprintf(b, "if %s {\n", nonEmpty(f, value))
+		}
+		switch {
+		case f.slice && f.kind == kindObject:
+			fmt.Fprintf(b, "w.Objects(%q, len(%s))\n", f.name, value)
+			fmt.Fprintf(b, "for i := range %s {\n", value)
+			fmt.Fprintf(b, "w.%sElement(&%s[i])\n}\n", objectMethod(f.elem, objects), value)
+		case f.slice:
+			fmt.Fprintf(b, "w.Array(%q, %s)\n", f.name, value)
+		case f.kind == kindObject:
+			fmt.Fprintf(b, "w.%s(%q, &%s)\n", objectMethod(f.typ, objects), f.name, value)
+		case f.kind == kindBytes:
+			fmt.Fprintf(b, "w.Bytes(%q, %s)\n", f.name, value)
+		case f.kind == kindByteArray:
+			fmt.Fprintf(b, "w.Bytes(%q, %s[:])\n", f.name, value)
+		default:
+			fmt.Fprintf(b, "w.%s(%q, %s)\n", basicMethods[f.typ], f.name, value)
+		}
+		if f.omitEmpty {
+			fmt.Fprintf(b, "}\n")
+		}
+	}
+	fmt.Fprintf(b, "return w.Err()\n}\n")
+}
+
+func writeUnmarshal(b *bytes.Buffer, t structType, objects map[string]bool) {
+	names := strings.ToLower(t.name[:1]) + t.name[1:] + "Entries"
+	fmt.Fprintf(b, "\nvar %s = []string{", names)
+	for i, f := range t.fields {
+		if i != 0 {
+			fmt.Fprintf(b, ", ")
+		}
+		fmt.Fprintf(b, "%q", f.name)
+	}
+	fmt.Fprintf(b, "}\n")
+
+	fmt.Fprintf(b, "\nfunc (m *%s) UnmarshalPortableObject(r *portable.ObjectReader) error {\n", t.name)
+	fmt.Fprintf(b, "for r.Next(%s) {\nswitch r.Index() {\n", names)
+	var required []string
+	for i, f := range t.fields {
+		value := "m." + f.goName
+		if !f.optional {
+			required = append(required, strconv.Itoa(i))
+		}
+
+		fmt.Fprintf(b, "case %d:\n", i)
+		switch {
+		case f.slice:
+			fmt.Fprintf(b, "%s = make(%s, 0, r.Array())\n", value, f.typ)
+			fmt.Fprintf(b, "for r.NextElement() {\n")
+			if f.kind == kindObject {
+				fmt.Fprintf(b, "%s = append(%s, %s{})\n", value, value, f.elem)
+				fmt.Fprintf(b, "r.%s(&%s[len(%s)-1])\n", objectMethod(f.elem, objects), value, value)
+			} else {
+				fmt.Fprintf(b, "%s = append(%s, r.%s())\n", value, value, basicMethods[f.elem])
+			}
+			fmt.Fprintf(b, "}\n")
+		case f.kind == kindObject:
+			fmt.Fprintf(b, "r.%s(&%s)\n", objectMethod(f.typ, objects), value)
+		case f.kind == kindBytes:
+			fmt.Fprintf(b, "%s = r.Bytes()\n", value)
+		case f.kind == kindByteArray:
+			fmt.Fprintf(b, "r.ByteArray(%s[:])\n", value)
+		default:
+			fmt.Fprintf(b, "%s = r.%s()\n", value, basicMethods[f.typ])
+		}
+	}
+	fmt.Fprintf(b, "}\n}\n")
+	fmt.Fprintf(b, "return r.End(%s)\n}\n", strings.Join(required, ", "))
+}
+
+func nonEmpty(f field, value string) string {
+	switch {
+	case f.slice || f.kind == kindBytes:
+		return fmt.Sprintf("len(%s) != 0", value)
+	case f.kind == kindByteArray:
+		return fmt.Sprintf("%s != (%s{})", value, f.typ)
+	case f.kind == kindBool:
+		return value
+	case f.kind == kindString:
+		return fmt.Sprintf("%s != \"\"", value)
+	}
+	return fmt.Sprintf("%s != 0", value)
+}
@@ -13,21 +13,35 @@ const (
 
 	bucketSize = 33
 
-	maxPacketSize = 16 * 1024 * 1024 // 16 MiB
+	maxPacketSize     = 16 * 1024 * 1024 // 16 MiB
+	maxFragmentedSize = 64 * 1024 * 1024 // Reassembled message limit
 
 	writeTimeout = 10 * time.Second
 	readTimeout  = 10 * time.Second
 
+	// Handlers running at once for a single connection
+	maxHandlers = 16
+
 	flagRequest  = 1
 	flagResponse = 2
+
+	// A message may be split into several fragments. Payloads of the
+	// fragments are concatenated into a full packet, header included. First
+	// fragment has flagBegin, last one has flagEnd and those in between have
+	// no flags at all. A packet with both flags set is a dummy one, which is
+	// used for traffic shaping and is silently discarded
+	flagBegin = 4
+	flagEnd   = 8
 )
 
 var (
 	ErrBadSign   = errors.New("net/levin: invalid bucket signature")
 	ErrBigPacket = errors.New("net/levin: received packet is too huge")
 	ErrVersion   = errors.New("net/levin: packet is of unknown version")
+	ErrFragment  = errors.New("net/levin: unexpected packet fragment")
 
 	ErrTimedOut = errors.New("net/levin: operation has timed out")
+	ErrClosed   = errors.New("net/levin: connection is closed")
 )
 
 type bucketHead struct {
@@ -36,6 +50,6 @@ type bucketHead struct {
 	ReturnData      bool   // true for INVOKE, false for NOTIFY
 	Command         uint32 // Command ID
 	ReturnCode      int32  // Always zero?
-	Flags           uint32 // 1 - Request, 2 - Response
+	Flags           uint32 // 1 - Request, 2 - Response, 4 and 8 - Fragment
 	ProtocolVersion uint32 // Only version 1 is supported currently
 }
@@ -0,0 +1,54 @@
+package levin
+
+import (
+	"fmt"
+)
+
+// ReturnCode is the status of a response as reported by the remote side.
+// Negative codes are errors
+type ReturnCode int32
+
+// Return codes used by the reference daemon
+const (
+	ReturnOK                  ReturnCode = 0
+	ReturnConnectionError     ReturnCode = -1
+	ReturnConnectionNotFound  ReturnCode = -2
+	ReturnConnectionDestroyed ReturnCode = -3
+	ReturnConnectionTimedOut  ReturnCode = -4
+	ReturnConnectionNoDuplex  ReturnCode = -5
+	ReturnConnectionNoHandler ReturnCode = -6
+	ReturnFormatError         ReturnCode = -7
+)
+
+var returnCodeNames = map[ReturnCode]string{
+	ReturnOK:                  "ok",
+	ReturnConnectionError:     "connection error",
+	ReturnConnectionNotFound:  "connection not found",
+	ReturnConnectionDestroyed: "connection destroyed",
+	ReturnConnectionTimedOut:  "connection timed out",
+	ReturnConnectionNoDuplex:  "no duplex protocol",
+	ReturnConnectionNoHandler: "handler not defined",
+	ReturnFormatError:         "format error",
+}
+
+func (c ReturnCode) String() string {
+	if name, ok := returnCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("return code %d", int32(c))
+}
+
+// IsError tells whether the code reports a failure
+func (c ReturnCode) IsError() bool {
+	return c < 0
+}
+
+// Error is returned by Invoke when the remote side reports a failure
+type Error struct {
+	Command uint32
+	Code    ReturnCode
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("net/levin: command %d failed: %s", e.Command, e.Code)
+}
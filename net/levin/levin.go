@@ -3,10 +3,9 @@ package levin
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -17,187 +16,580 @@ import (
 type Conn interface {
 	Close()
 
-	// Notify(command uint32, packet []byte) error
-	Invoke(commandId uint32, request interface{}, response interface{}, timeout time.Duration) (int32, error)
-	// Respond(command uint32, packet []byte) error
-
-	// Receive() ([]byte, *bucketHead, error)
+	// Sends a request without waiting for any answer
+	Notify(commandId uint32, request interface{}) error
+	// Sends a request and waits for the response. If the peer reports a
+	// failure, *Error is returned
+	Invoke(commandId uint32, request interface{}, response interface{}, timeout time.Duration) (ReturnCode, error)
+	// Same as Invoke, but waits until ctx is done instead of a fixed timeout
+	InvokeContext(ctx context.Context, commandId uint32, request interface{}, response interface{}) (ReturnCode, error)
+	// Answers the request previously received from the peer
+	Respond(commandId uint32, returnCode ReturnCode, response interface{}) error
 
 	// Returns a custom, user-defined context
 	Context() *interface{}
+
+	RemoteAddr() net.Addr
+
+	// Returned channel is closed once the connection is closed by either side
+	Done() <-chan struct{}
+
+	// Packets bigger than size are sent in fragments. Zero disables
+	// fragmentation, which is the default
+	SetFragmentSize(size uint64)
+	// Sends a dummy packet of the given size, which the peer discards
+	Noise(size uint64) error
+
+	// Returns a snapshot of the traffic counters
+	Stats() Stats
+	// Sets an observer, which is notified about the traffic. May be nil
+	SetObserver(o Observer)
 }
 
 type conn struct {
 	conn    net.Conn
 	context interface{}
+	router  *Router
 
-	newMappings chan packetMapping
+	writeMutex   sync.Mutex // header and body must not interleave
+	fragmentSize uint64     // guarded by writeMutex
 
-	stopReceiveRoutine chan struct{}
-	wg                 sync.WaitGroup
+	fragments []byte // message being reassembled, only used by the reader
+
+	mutex    sync.Mutex // guards pending, closed and closeErr
+	pending  map[uint32][]*pendingInvoke
+	closed   bool
+	closeErr error // why the receive routine has stopped
+
+	statsMutex sync.Mutex // guards stats and observer
+	stats      Stats
+	observer   Observer
+
+	handlers chan struct{} // one token per running handler, see Router
+
+	done         chan struct{}
+	closing      chan struct{} // closed along with the socket
+	closeOnce    sync.Once
+	receiverDone chan struct{}
 }
 
-type invokeResponse struct {
-	head bucketHead
-	data []byte
+// Invoke waiting for its response. The receive routine decodes the response
+// body straight into response, unless the invoke is abandoned by then
+type pendingInvoke struct {
+	response  interface{}
+	result    chan responseResult
+	receiving bool // guarded by conn.mutex
+	abandoned bool // guarded by conn.mutex
 }
 
-type packetMapping struct {
-	id           uint32
-	responseChan chan invokeResponse
+type responseResult struct {
+	code ReturnCode
+	err  error // decoding error
 }
 
-func Dial(address string) (*conn, error) {
-	c, err := net.Dial("tcp", address)
+// Dial connects to the given address. Incoming requests are served by
+// router, which may be nil
+func Dial(address string, router *Router) (*conn, error) {
+	return DialContext(context.Background(), address, router)
+}
+
+// DialContext is the same as Dial, but the connection attempt is aborted when
+// ctx is done
+func DialContext(ctx context.Context, address string, router *Router) (*conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	return NewConn(c, router), nil
+}
+
+// NewConn wraps an established connection of any kind (e.g. one end of
+// net.Pipe) and starts its receive routine
+func NewConn(c net.Conn, router *Router) *conn {
 	node := &conn{
 		conn:    c,
 		context: struct{}{},
+		router:  router,
+
+		pending: make(map[uint32][]*pendingInvoke),
+
+		stats: Stats{
+			Commands:     make(map[uint32]CommandStats),
+			Connected:    time.Now(),
+			LastActivity: time.Now(),
+		},
 
-		newMappings: make(chan packetMapping),
+		handlers: make(chan struct{}, maxHandlers),
 
-		stopReceiveRoutine: make(chan struct{}),
+		done:         make(chan struct{}),
+		closing:      make(chan struct{}),
+		receiverDone: make(chan struct{}),
 	}
 
-	node.wg.Add(1)
 	go node.receiveRoutine()
-	return node, nil
+	return node
 }
 
+// Close closes the socket and waits for the receive routine to finish.
+// Pending invokes fail with ErrClosed. It is safe to call Close many times
+// and from the handlers
 func (c *conn) Close() {
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
-	}
+	c.closeSocket()
+	<-c.receiverDone
+}
 
-	close(c.stopReceiveRoutine)
-	c.wg.Wait()
+// Closes the socket, which stops the receive routine
+func (c *conn) closeSocket() {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.conn.Close()
+	})
 }
 
 func (c *conn) Context() *interface{} {
 	return &c.context
 }
 
-func (c *conn) Invoke(commandId uint32, request interface{}, response interface{}, timeout time.Duration) (int32, error) {
+func (c *conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *conn) SetFragmentSize(size uint64) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.fragmentSize = size
+}
+
+func (c *conn) Noise(size uint64) error {
+	var b bytes.Buffer
+	head := bucketHead{levinSignature, size, false, 0, 0, flagBegin | flagEnd, currentVersion}
+	if err := binary.Write(&b, binary.LittleEndian, head); err != nil {
+		return err
+	}
+	b.Write(make([]byte, size))
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.write(b.Bytes())
+}
+
+func (c *conn) Notify(commandId uint32, request interface{}) error {
 	packet, err := portable.Marshal(request)
 	if err != nil {
-		return -1, err
+		return err
+	}
+	return c.sendCommand(commandId, packet, false, flagRequest, 0)
+}
+
+func (c *conn) Respond(commandId uint32, returnCode ReturnCode, response interface{}) error {
+	packet, err := portable.Marshal(response)
+	if err != nil {
+		return err
 	}
-	if err = c.sendCommand(commandId, packet, true, flagRequest); err != nil {
+	return c.sendCommand(commandId, packet, false, flagResponse, returnCode)
+}
+
+func (c *conn) Invoke(commandId uint32, request interface{}, response interface{}, timeout time.Duration) (ReturnCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.InvokeContext(ctx, commandId, request, response)
+}
+
+func (c *conn) InvokeContext(ctx context.Context, commandId uint32, request interface{}, response interface{}) (ReturnCode, error) {
+	start := time.Now()
+	code, err := c.invoke(ctx, commandId, request, response)
+	c.recordInvoke(commandId, time.Since(start), err)
+	return code, err
+}
+
+func (c *conn) invoke(ctx context.Context, commandId uint32, request interface{}, response interface{}) (ReturnCode, error) {
+	packet, err := portable.Marshal(request)
+	if err != nil {
 		return -1, err
 	}
 
-	responseChan := make(chan invokeResponse, 1)
-	c.newMappings <- packetMapping{commandId, responseChan}
+	// Register before sending, so a quick response can't slip by
+	p := &pendingInvoke{response: response, result: make(chan responseResult, 1)}
+	if err := c.addPending(commandId, p); err != nil {
+		return -1, err
+	}
+	if err = c.sendCommand(commandId, packet, true, flagRequest, 0); err != nil {
+		c.removePending(commandId, p)
+		return -1, err
+	}
 
+	// Timed out invokes stay pending, so their late responses are consumed
+	// in order and don't get mixed up with the following ones
+	var r responseResult
+	var ok bool
 	select {
-	case <-time.After(timeout):
-		return -1, ErrTimedOut
-	case r, ok := <-responseChan:
-		if !ok {
-			return -1, fmt.Errorf("Connection closed")
-		}
-		if r.head.Command != commandId {
-			log.Panicln("fixme: please contact devs. This should never happen, lol")
+	case <-ctx.Done():
+		if c.abandon(p) {
+			if ctx.Err() == context.DeadlineExceeded {
+				return -1, ErrTimedOut
+			}
+			return -1, ctx.Err()
 		}
+		// Too late, the response is being decoded into response already
+		r, ok = <-p.result
+	case r, ok = <-p.result:
+	}
+	if !ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return -1, c.closeReason()
+	}
+	if r.code.IsError() {
+		return r.code, &Error{commandId, r.code}
+	}
+	if r.err != nil {
+		return -1, r.err
+	}
+	return r.code, nil
+}
 
-		if err := portable.Unmarshal(r.data, response); err != nil {
-			return -1, err
+func (c *conn) addPending(commandId uint32, p *pendingInvoke) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return c.closeReason()
+	}
+	c.pending[commandId] = append(c.pending[commandId], p)
+	return nil
+}
+
+func (c *conn) removePending(commandId uint32, p *pendingInvoke) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending := c.pending[commandId]
+	for i := range pending {
+		if pending[i] == p {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
 		}
-		return r.head.ReturnCode, nil
+	}
+	if len(pending) == 0 {
+		delete(c.pending, commandId)
+	} else {
+		c.pending[commandId] = pending
 	}
 }
 
-// Receives new packets and directs those where needed. Also listens to
-// newMappings channel
-func (c *conn) receiveRoutine() {
-	defer c.wg.Done()
+// Returns the oldest invoke waiting for commandId, if any. Unless the invoke
+// is abandoned, it may not be abandoned anymore
+func (c *conn) popPending(commandId uint32) (*pendingInvoke, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	head := bucketHead{}
-	bucketBuffer := make([]byte, bucketSize)
+	pending := c.pending[commandId]
+	if len(pending) == 0 {
+		return nil, false
+	}
+	if len(pending) == 1 {
+		delete(c.pending, commandId)
+	} else {
+		c.pending[commandId] = pending[1:]
+	}
+	p := pending[0]
+	p.receiving = !p.abandoned
+	return p, p.receiving
+}
 
-	responseMap := make(map[uint32](chan invokeResponse))
+// Gives up waiting for the response. Fails if the response is being received
+// already
+func (c *conn) abandon(p *pendingInvoke) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if p.receiving {
+		return false
+	}
+	p.abandoned = true
+	return true
+}
+
+// Reads packets until the socket is closed or broken and directs them where
+// needed
+func (c *conn) receiveRoutine() {
+	defer close(c.receiverDone)
 
-receiveLoop:
 	for {
-		select {
-		case <-c.stopReceiveRoutine:
-			break receiveLoop
-		case mapping := <-c.newMappings:
-			if _, present := responseMap[mapping.id]; present {
-				close(mapping.responseChan)
-				break receiveLoop
-			}
-			responseMap[mapping.id] = mapping.responseChan
-		default:
+		head, body, err := c.readPacket()
+		if err != nil {
+			c.shutdown(err)
+			return
 		}
+		c.recordReceived(head.Command, bucketSize+int(body.N))
 
-		if _, err := io.ReadFull(c.conn, bucketBuffer); err != nil {
-			break receiveLoop
+		if head.Flags == flagResponse {
+			c.receiveResponse(head, body)
+		} else if head.Flags == flagRequest {
+			c.router.receive(c, head, body)
 		}
-		if err := binary.Read(bytes.NewBuffer(bucketBuffer), binary.LittleEndian, &head); err != nil {
-			break receiveLoop
+
+		// Skip whatever the decoder has left unread
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			c.shutdown(err)
+			return
+		}
+		if body.N != 0 {
+			c.shutdown(io.ErrUnexpectedEOF)
+			return
 		}
+	}
+}
+
+func (c *conn) receiveResponse(head bucketHead, body io.Reader) {
+	p, ok := c.popPending(head.Command)
+	if !ok {
+		// log.Println("Received response", head.Command, "but nobody waits for it :)")
+		return
+	}
+
+	r := responseResult{code: ReturnCode(head.ReturnCode)}
+	if !r.code.IsError() {
+		r.err = portable.NewDecoder(body).Decode(p.response)
+	}
+	p.result <- r
+	close(p.result)
+}
+
+// Marks the connection closed and fails all pending invokes
+func (c *conn) shutdown(reason error) {
+	c.closeSocket()
 
-		// // Check response
-		if head.Signature != levinSignature {
-			break receiveLoop
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	c.closeErr = reason
+	for _, pending := range c.pending {
+		for _, p := range pending {
+			close(p.result)
+		}
+	}
+	c.pending = nil
+	close(c.done)
+}
+
+// Protocol violations are reported as is, everything else is just ErrClosed.
+// Must be called with mutex held
+func (c *conn) closeReason() error {
+	switch c.closeErr {
+	case ErrBadSign, ErrBigPacket, ErrVersion, ErrFragment:
+		return c.closeErr
+	}
+	return ErrClosed
+}
+
+// Reads a single packet, reassembling it from fragments if needed. Dummy
+// packets are skipped. Bodies of whole packets are not read here, they are
+// streamed right from the socket and must be consumed before the next call
+func (c *conn) readPacket() (bucketHead, *io.LimitedReader, error) {
+	for {
+		head, err := c.readHead()
+		if err != nil {
+			return head, nil, err
 		}
-		if head.ProtocolVersion != currentVersion {
-			break receiveLoop
+
+		fragmentFlags := head.Flags & (flagBegin | flagEnd)
+		if fragmentFlags == flagBegin|flagEnd {
+			if _, err := io.CopyN(io.Discard, timeoutReader{c.conn}, int64(head.PacketSize)); err != nil {
+				return head, nil, err
+			}
+			continue
 		}
-		if head.PacketSize > maxPacketSize {
-			break receiveLoop
+		if fragmentFlags == 0 && head.Flags != 0 {
+			if c.fragments != nil {
+				return head, nil, ErrFragment
+			}
+			return head, &io.LimitedReader{R: timeoutReader{c.conn}, N: int64(head.PacketSize)}, nil
 		}
 
+		if head.Flags&flagBegin != 0 {
+			if c.fragments != nil {
+				return head, nil, ErrFragment
+			}
+			c.fragments = make([]byte, 0, head.PacketSize)
+		} else if c.fragments == nil {
+			return head, nil, ErrFragment
+		}
+		if uint64(len(c.fragments))+head.PacketSize > maxFragmentedSize {
+			return head, nil, ErrBigPacket
+		}
 		data := make([]byte, head.PacketSize)
-		if _, err := io.ReadFull(c.conn, data); err != nil {
-			break receiveLoop
+		if _, err := io.ReadFull(timeoutReader{c.conn}, data); err != nil {
+			return head, nil, err
 		}
-
-		if _, present := responseMap[head.Command]; present && head.Flags == flagResponse {
-			responseMap[head.Command] <- invokeResponse{head, data}
-			close(responseMap[head.Command])
-			delete(responseMap, head.Command)
-			// log.Println("Sent packet", head.Command, "for handling :)")
-		} else {
-			// log.Println("Received packet", head.Command, "but did not handle :)")
+		c.fragments = append(c.fragments, data...)
+
+		if head.Flags&flagEnd != 0 {
+			message := c.fragments
+			c.fragments = nil
+			head, data, err := parseFragmented(message)
+			if err != nil {
+				return head, nil, err
+			}
+			return head, &io.LimitedReader{R: bytes.NewReader(data), N: int64(len(data))}, nil
 		}
 	}
+}
 
-	// Loop ended, close all invoked sockets
-	for _, c := range responseMap {
-		close(c)
+// Parses a packet reassembled from fragments
+func parseFragmented(message []byte) (bucketHead, []byte, error) {
+	head := bucketHead{}
+	if len(message) < bucketSize {
+		return head, nil, ErrFragment
 	}
-	// Make SURE there are no new mappings
-	done := false
-	for !done {
-		select {
-		case mapping := <-c.newMappings:
-			close(mapping.responseChan)
-		default:
-			done = true
-		}
+	if err := binary.Read(bytes.NewBuffer(message[:bucketSize]), binary.LittleEndian, &head); err != nil {
+		return head, nil, err
+	}
+	if err := checkHead(&head, maxFragmentedSize); err != nil {
+		return head, nil, err
+	}
+	if head.Flags&(flagBegin|flagEnd) != 0 || head.PacketSize != uint64(len(message)-bucketSize) {
+		return head, nil, ErrFragment
+	}
+	return head, message[bucketSize:], nil
+}
+
+// Validates a header of a bucket or of a packet reassembled from fragments.
+// Those have different size limits
+func checkHead(head *bucketHead, maxSize uint64) error {
+	if head.Signature != levinSignature {
+		return ErrBadSign
+	}
+	if head.ProtocolVersion != currentVersion {
+		return ErrVersion
+	}
+	if head.PacketSize > maxSize {
+		return ErrBigPacket
+	}
+	return nil
+}
+
+// Reads a bucket header. The socket may stay quiet between packets for as
+// long as it wants, but once a header arrives the rest of the packet must
+// keep coming, see timeoutReader
+func (c *conn) readHead() (bucketHead, error) {
+	head := bucketHead{}
+	bucketBuffer := make([]byte, bucketSize)
+
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return head, err
+	}
+	if _, err := io.ReadFull(c.conn, bucketBuffer[:1]); err != nil {
+		return head, err
+	}
+	if _, err := io.ReadFull(timeoutReader{c.conn}, bucketBuffer[1:]); err != nil {
+		return head, err
 	}
+	if err := binary.Read(bytes.NewBuffer(bucketBuffer), binary.LittleEndian, &head); err != nil {
+		return head, err
+	}
+
+	if err := checkHead(&head, maxPacketSize); err != nil {
+		return head, err
+	}
+	return head, nil
+}
+
+// Reads the middle of a packet. Every read gets readTimeout of its own, so a
+// big body on a slow link is fine as long as the data keeps coming, while a
+// stalled peer is dropped after readTimeout no matter how big the body is
+type timeoutReader struct {
+	conn net.Conn
 }
 
-func (c *conn) sendCommand(command uint32, packet []byte, needsReturn bool, flags uint32) error {
+func (r timeoutReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
+func (c *conn) sendCommand(command uint32, packet []byte, needsReturn bool, flags uint32, returnCode ReturnCode) error {
 	head := bucketHead{
 		levinSignature,
 		uint64(len(packet)),
 		needsReturn, command,
-		0, flags, 1,
+		int32(returnCode), flags, currentVersion,
+	}
+
+	if bucketSize+len(packet) > maxFragmentedSize {
+		return ErrBigPacket
+	}
+
+	var b bytes.Buffer
+	b.Grow(bucketSize + len(packet))
+	err := binary.Write(&b, binary.LittleEndian, head)
+	if err != nil {
+		return err
 	}
+	b.Write(packet)
 
-	// c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	// Concurrent senders must not interleave their packets
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 
-	// Write packet header and data
-	if err := binary.Write(c.conn, binary.LittleEndian, head); err != nil {
+	if c.fragmentSize == 0 || uint64(b.Len()) <= c.fragmentSize {
+		err = c.write(b.Bytes())
+	} else {
+		err = c.writeFragmented(b.Bytes())
+	}
+	if err != nil {
 		return err
 	}
-	if _, err := c.conn.Write(packet); err != nil {
+	c.recordSent(command, b.Len())
+	return nil
+}
+
+// Splits a full packet into fragments of at most fragmentSize bytes each.
+// Must be called with writeMutex held
+func (c *conn) writeFragmented(message []byte) error {
+	var b bytes.Buffer
+	for offset := uint64(0); offset < uint64(len(message)); offset += c.fragmentSize {
+		end := offset + c.fragmentSize
+		if end > uint64(len(message)) {
+			end = uint64(len(message))
+		}
+
+		flags := uint32(0)
+		if offset == 0 {
+			flags |= flagBegin
+		}
+		if end == uint64(len(message)) {
+			flags |= flagEnd
+		}
+
+		head := bucketHead{levinSignature, end - offset, false, 0, 0, flags, currentVersion}
+		if err := binary.Write(&b, binary.LittleEndian, head); err != nil {
+			return err
+		}
+		b.Write(message[offset:end])
+	}
+	return c.write(b.Bytes())
+}
+
+// Must be called with writeMutex held. A failed write may leave a part of the
+// packet in the stream, so the socket is closed and the next sender can't
+// follow it up with a fresh header. The receive routine then stops and fails
+// the pending invokes
+func (c *conn) write(data []byte) error {
+	err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err == nil {
+		_, err = c.conn.Write(data)
+	}
+	if err != nil {
+		c.closeSocket()
 		return err
 	}
 
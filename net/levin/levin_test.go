@@ -0,0 +1,533 @@
+package levin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
+)
+
+const testCommandId = 1001
+
+type testMessage struct {
+	Value uint64 `store:"value"`
+	Text  string `store:"text"`
+}
+
+// Scripted remote side of a net.Pipe
+type fakePeer struct {
+	t     *testing.T
+	conn  net.Conn
+	local *conn
+}
+
+func newTestConn(t *testing.T, router *Router) (*conn, *fakePeer) {
+	local, remote := net.Pipe()
+	c := NewConn(local, router)
+	return c, &fakePeer{t, remote, c}
+}
+
+func (p *fakePeer) close() {
+	p.conn.Close()
+	p.local.Close()
+}
+
+func (p *fakePeer) writeBucket(head bucketHead, data []byte) {
+	p.t.Helper()
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, head); err != nil {
+		p.t.Fatal(err)
+	}
+	b.Write(data)
+	if _, err := p.conn.Write(b.Bytes()); err != nil {
+		p.t.Error("fake peer write:", err)
+	}
+}
+
+func (p *fakePeer) writeMessage(command uint32, returnData bool, returnCode int32, flags uint32, v interface{}) {
+	p.t.Helper()
+
+	data, err := portable.Marshal(v)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.writeBucket(bucketHead{
+		levinSignature, uint64(len(data)), returnData,
+		command, returnCode, flags, currentVersion,
+	}, data)
+}
+
+func (p *fakePeer) readBucket() (bucketHead, []byte) {
+	p.t.Helper()
+
+	head := bucketHead{}
+	if err := binary.Read(p.conn, binary.LittleEndian, &head); err != nil {
+		p.t.Fatal("fake peer read:", err)
+	}
+	data := make([]byte, head.PacketSize)
+	if _, err := io.ReadFull(p.conn, data); err != nil {
+		p.t.Fatal("fake peer read:", err)
+	}
+	return head, data
+}
+
+func (p *fakePeer) readMessage(v interface{}) bucketHead {
+	p.t.Helper()
+
+	head, data := p.readBucket()
+	if err := portable.Unmarshal(data, v); err != nil {
+		p.t.Fatal(err)
+	}
+	return head
+}
+
+type invokeResult struct {
+	code ReturnCode
+	err  error
+}
+
+func invokeAsync(c *conn, response interface{}, timeout time.Duration) chan invokeResult {
+	result := make(chan invokeResult, 1)
+	go func() {
+		code, err := c.Invoke(testCommandId, &testMessage{1, "ping"}, response, timeout)
+		result <- invokeResult{code, err}
+	}()
+	return result
+}
+
+func TestInvoke(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	response := &testMessage{}
+	result := invokeAsync(c, response, time.Second)
+
+	request := &testMessage{}
+	head := peer.readMessage(request)
+	if !head.ReturnData || head.Flags != flagRequest || head.Command != testCommandId {
+		t.Fatalf("unexpected request head: %+v", head)
+	}
+	if *request != (testMessage{1, "ping"}) {
+		t.Fatalf("unexpected request: %+v", request)
+	}
+	peer.writeMessage(testCommandId, false, 1, flagResponse, &testMessage{2, "pong"})
+
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.code != 1 {
+		t.Errorf("return code = %d, want 1", r.code)
+	}
+	if *response != (testMessage{2, "pong"}) {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+func TestInvokeError(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	result := invokeAsync(c, &testMessage{}, time.Second)
+	peer.readMessage(&testMessage{})
+	peer.writeBucket(bucketHead{
+		levinSignature, 0, false, testCommandId,
+		int32(ReturnFormatError), flagResponse, currentVersion,
+	}, nil)
+
+	r := <-result
+	var levinErr *Error
+	if !errors.As(r.err, &levinErr) {
+		t.Fatalf("err = %v, want *Error", r.err)
+	}
+	if levinErr.Command != testCommandId || levinErr.Code != ReturnFormatError {
+		t.Errorf("unexpected error: %+v", levinErr)
+	}
+}
+
+func TestInvokeFIFO(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	first, second := &testMessage{}, &testMessage{}
+	firstResult := invokeAsync(c, first, time.Second)
+	peer.readMessage(&testMessage{})
+	secondResult := invokeAsync(c, second, time.Second)
+	peer.readMessage(&testMessage{})
+
+	peer.writeMessage(testCommandId, false, 0, flagResponse, &testMessage{1, "first"})
+	peer.writeMessage(testCommandId, false, 0, flagResponse, &testMessage{2, "second"})
+
+	if r := <-firstResult; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r := <-secondResult; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if first.Text != "first" || second.Text != "second" {
+		t.Errorf("responses are mixed up: %+v, %+v", first, second)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	go c.Notify(testCommandId, &testMessage{3, "notify"})
+
+	request := &testMessage{}
+	head := peer.readMessage(request)
+	if head.ReturnData || head.Flags != flagRequest || head.ReturnCode != 0 {
+		t.Fatalf("unexpected notify head: %+v", head)
+	}
+	if *request != (testMessage{3, "notify"}) {
+		t.Errorf("unexpected notify: %+v", request)
+	}
+}
+
+func TestRouterRespond(t *testing.T) {
+	notified := make(chan *testMessage, 1)
+	router := NewRouter()
+	router.Handle(testCommandId, testMessage{}, func(c Conn, request interface{}) (interface{}, ReturnCode) {
+		r := request.(*testMessage)
+		return &testMessage{r.Value + 1, r.Text}, 5
+	})
+	router.HandleNotify(testCommandId+1, &testMessage{}, func(c Conn, request interface{}) {
+		notified <- request.(*testMessage)
+	})
+	_, peer := newTestConn(t, router)
+	defer peer.close()
+
+	peer.writeMessage(testCommandId+1, false, 0, flagRequest, &testMessage{7, "notify"})
+	select {
+	case r := <-notified:
+		if *r != (testMessage{7, "notify"}) {
+			t.Errorf("unexpected notify: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notify handler was not called")
+	}
+
+	peer.writeMessage(testCommandId, true, 0, flagRequest, &testMessage{41, "invoke"})
+	response := &testMessage{}
+	head := peer.readMessage(response)
+	if head.ReturnData || head.Flags != flagResponse || head.ReturnCode != 5 {
+		t.Fatalf("unexpected response head: %+v", head)
+	}
+	if *response != (testMessage{42, "invoke"}) {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+func TestRouterHandlerLimit(t *testing.T) {
+	var running, peak int32
+	release := make(chan struct{})
+	served := make(chan struct{}, 2*maxHandlers)
+
+	router := NewRouter()
+	router.HandleNotify(testCommandId, testMessage{}, func(c Conn, request interface{}) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		served <- struct{}{}
+	})
+	c, peer := newTestConn(t, router)
+	defer peer.close()
+
+	// The receive loop stalls on the first notify over the limit, so the
+	// peer can't send them all until the handlers are released
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 2*maxHandlers; i++ {
+			peer.writeMessage(testCommandId, false, 0, flagRequest, &testMessage{})
+		}
+	}()
+	select {
+	case <-sent:
+		t.Fatal("receive loop does not wait for busy handlers")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	<-sent
+	for i := 0; i < 2*maxHandlers; i++ {
+		<-served
+	}
+	if peak > maxHandlers {
+		t.Errorf("%d handlers have run at once, limit is %d", peak, maxHandlers)
+	}
+
+	// Close must not hang on a receive loop waiting for a handler slot
+	c.Close()
+}
+
+func TestRouterNoHandler(t *testing.T) {
+	_, peer := newTestConn(t, NewRouter())
+	defer peer.close()
+
+	peer.writeMessage(testCommandId, true, 0, flagRequest, &testMessage{})
+	head, data := peer.readBucket()
+	if head.Flags != flagResponse || ReturnCode(head.ReturnCode) != ReturnConnectionNoHandler {
+		t.Fatalf("unexpected response head: %+v", head)
+	}
+	if len(data) != 0 {
+		t.Errorf("unexpected response body: %x", data)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	result := invokeAsync(c, &testMessage{}, 50*time.Millisecond)
+	peer.readMessage(&testMessage{})
+
+	if r := <-result; r.err != ErrTimedOut {
+		t.Errorf("err = %v, want %v", r.err, ErrTimedOut)
+	}
+}
+
+// Response bodies are decoded straight from the socket, so whatever the
+// decoder leaves unread must be skipped
+func TestMalformedResponse(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	result := invokeAsync(c, &testMessage{}, time.Second)
+	peer.readMessage(&testMessage{})
+	garbage := []byte("definitely not a portable storage")
+	peer.writeBucket(bucketHead{
+		levinSignature, uint64(len(garbage)), false,
+		testCommandId, 0, flagResponse, currentVersion,
+	}, garbage)
+	if r := <-result; r.err != portable.ErrSigMismatch {
+		t.Errorf("err = %v, want %v", r.err, portable.ErrSigMismatch)
+	}
+
+	response := &testMessage{}
+	result = invokeAsync(c, response, time.Second)
+	peer.readMessage(&testMessage{})
+	body, _ := portable.Marshal(&testMessage{2, "pong"})
+	body = append(body, "trailing junk"...)
+	peer.writeBucket(bucketHead{
+		levinSignature, uint64(len(body)), false,
+		testCommandId, 0, flagResponse, currentVersion,
+	}, body)
+	if r := <-result; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if *response != (testMessage{2, "pong"}) {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	result := invokeAsync(c, &testMessage{}, time.Second)
+	peer.readMessage(&testMessage{})
+	peer.conn.Close()
+
+	if r := <-result; r.err != ErrClosed {
+		t.Errorf("err = %v, want %v", r.err, ErrClosed)
+	}
+	<-c.Done()
+	if _, err := c.Invoke(testCommandId, &testMessage{}, &testMessage{}, time.Second); err != ErrClosed {
+		t.Errorf("err = %v, want %v", err, ErrClosed)
+	}
+}
+
+// Socket which accepts only a part of the first write and fails
+type brokenWriter struct {
+	net.Conn
+}
+
+func (w brokenWriter) Write(data []byte) (int, error) {
+	n, _ := w.Conn.Write(data[:len(data)/2])
+	return n, errors.New("broken pipe")
+}
+
+func TestBrokenWrite(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := NewConn(brokenWriter{local}, nil)
+	defer c.Close()
+	go io.Copy(io.Discard, remote)
+
+	result := invokeAsync(c, &testMessage{}, time.Second)
+	if r := <-result; r.err == nil {
+		t.Fatal("invoke succeeded on a broken socket")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed after a partial write")
+	}
+	if err := c.Notify(testCommandId, &testMessage{}); err == nil {
+		t.Error("notify succeeded after a partial write")
+	}
+}
+
+func TestBrokenPackets(t *testing.T) {
+	tests := []struct {
+		name string
+		head bucketHead
+		err  error
+	}{
+		{"bad signature", bucketHead{0x0101010101010101, 0, false, testCommandId, 0, flagResponse, currentVersion}, ErrBadSign},
+		{"big packet", bucketHead{levinSignature, maxPacketSize + 1, false, testCommandId, 0, flagResponse, currentVersion}, ErrBigPacket},
+		{"version mismatch", bucketHead{levinSignature, 0, false, testCommandId, 0, flagResponse, currentVersion + 1}, ErrVersion},
+		{"stray fragment", bucketHead{levinSignature, 0, false, 0, 0, flagEnd, currentVersion}, ErrFragment},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, peer := newTestConn(t, nil)
+			defer peer.close()
+
+			result := invokeAsync(c, &testMessage{}, time.Second)
+			peer.readMessage(&testMessage{})
+			peer.writeBucket(test.head, nil)
+
+			if r := <-result; r.err != test.err {
+				t.Errorf("err = %v, want %v", r.err, test.err)
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Error("connection was not closed")
+			}
+		})
+	}
+}
+
+func TestFragments(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+	c.SetFragmentSize(bucketSize + 8)
+
+	response := &testMessage{}
+	result := invokeAsync(c, response, time.Second)
+
+	// Outgoing request should come in fragments
+	var message []byte
+	for {
+		head, data := peer.readBucket()
+		if len(message) == 0 && head.Flags != flagBegin {
+			t.Fatalf("unexpected first fragment flags: %d", head.Flags)
+		}
+		message = append(message, data...)
+		if head.Flags&flagEnd != 0 {
+			break
+		}
+	}
+	head, data, err := parseFragmented(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &testMessage{}
+	if err := portable.Unmarshal(data, request); err != nil {
+		t.Fatal(err)
+	}
+	if head.Command != testCommandId || *request != (testMessage{1, "ping"}) {
+		t.Fatalf("unexpected reassembled request: %+v %+v", head, request)
+	}
+
+	// Send the response back in three fragments with some noise around
+	var b bytes.Buffer
+	body, _ := portable.Marshal(&testMessage{2, "fragmented pong"})
+	binary.Write(&b, binary.LittleEndian, bucketHead{
+		levinSignature, uint64(len(body)), false,
+		testCommandId, 0, flagResponse, currentVersion,
+	})
+	b.Write(body)
+	full := b.Bytes()
+
+	third := len(full) / 3
+	peer.writeBucket(bucketHead{levinSignature, 4, false, 0, 0, flagBegin | flagEnd, currentVersion}, make([]byte, 4))
+	peer.writeBucket(bucketHead{levinSignature, uint64(third), false, 0, 0, flagBegin, currentVersion}, full[:third])
+	peer.writeBucket(bucketHead{levinSignature, uint64(third), false, 0, 0, 0, currentVersion}, full[third:2*third])
+	peer.writeBucket(bucketHead{levinSignature, uint64(len(full) - 2*third), false, 0, 0, flagEnd, currentVersion}, full[2*third:])
+
+	if r := <-result; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if *response != (testMessage{2, "fragmented pong"}) {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+// Larger than a single bucket may be, but every string fits the default
+// portable limits
+type testBigMessage struct {
+	Parts []string `store:"parts"`
+}
+
+func TestBigFragmentedMessage(t *testing.T) {
+	router := NewRouter()
+	router.Handle(testCommandId, testBigMessage{}, func(c Conn, request interface{}) (interface{}, ReturnCode) {
+		return request, ReturnOK
+	})
+	local, remote := net.Pipe()
+	c := NewConn(local, nil)
+	server := NewConn(remote, router)
+	defer c.Close()
+	defer server.Close()
+	c.SetFragmentSize(1 << 20)
+	server.SetFragmentSize(1 << 20)
+
+	part := string(bytes.Repeat([]byte{0xa5}, 6<<20))
+	request := &testBigMessage{[]string{part, part, part}}
+	response := &testBigMessage{}
+	if _, err := c.Invoke(testCommandId, request, response, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Parts) != 3 || response.Parts[2] != part {
+		t.Error("big message is mangled")
+	}
+
+	// Reassembled messages have a limit of their own
+	huge := &testBigMessage{[]string{part, part, part, part, part, part, part, part, part, part, part}}
+	if _, err := c.Invoke(testCommandId, huge, response, time.Second); err != ErrBigPacket {
+		t.Errorf("err = %v, want %v", err, ErrBigPacket)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, peer := newTestConn(t, nil)
+	defer peer.close()
+
+	result := invokeAsync(c, &testMessage{}, time.Second)
+	_, request := peer.readBucket()
+	peer.writeMessage(testCommandId, false, 0, flagResponse, &testMessage{2, "pong"})
+	if r := <-result; r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	s := c.Stats()
+	cs := s.Commands[testCommandId]
+	if cs.PacketsOut != 1 || cs.BytesOut != uint64(bucketSize+len(request)) {
+		t.Errorf("unexpected outgoing counters: %+v", cs)
+	}
+	if cs.PacketsIn != 1 || s.Total.PacketsIn != 1 {
+		t.Errorf("unexpected incoming counters: %+v", cs)
+	}
+	if s.Invokes != 1 || s.Timeouts != 0 {
+		t.Errorf("unexpected invoke counters: %+v", s)
+	}
+}
@@ -0,0 +1,53 @@
+package levin
+
+import (
+	"net"
+)
+
+// Listener accepts incoming levin connections
+type Listener struct {
+	listener net.Listener
+	router   *Router
+}
+
+// Listen announces on the given TCP address. Accepted connections are
+// wrapped the same way as the dialed ones and share the router
+func Listen(address string, router *Router) (*Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{listener: l, router: router}, nil
+}
+
+// Accept waits for the next incoming connection and starts its receive
+// routine
+func (l *Listener) Accept() (*conn, error) {
+	c, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, l.router), nil
+}
+
+// Serve accepts incoming connections and passes each of them to handler
+// until the listener is closed. Handler is called from the Serve goroutine,
+// so it should not block for long
+func (l *Listener) Serve(handler func(Conn)) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		handler(c)
+	}
+}
+
+// Close stops listening. Already accepted connections are not closed
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
@@ -0,0 +1,141 @@
+package levin
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"sync"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
+)
+
+// HandlerFunc serves an invoke request. The returned response is sent back to
+// the peer along with the return code. If response is nil, nothing is sent and
+// the handler is expected to call Respond on its own
+type HandlerFunc func(c Conn, request interface{}) (response interface{}, returnCode ReturnCode)
+
+// NotifyFunc serves a notification. Nothing is sent back to the peer
+type NotifyFunc func(c Conn, request interface{})
+
+// Router directs incoming requests and notifications to registered handlers.
+// A single router may be shared between many connections
+type Router struct {
+	mutex    sync.RWMutex
+	handlers map[uint32]handler
+}
+
+type handler struct {
+	requestType reflect.Type
+	invoke      HandlerFunc
+	notify      NotifyFunc
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[uint32]handler),
+	}
+}
+
+// Handle registers handler for invokes of commandId. Each request is decoded
+// into a newly allocated value of the same type as request, and a pointer to
+// it is passed to the handler
+func (r *Router) Handle(commandId uint32, request interface{}, h HandlerFunc) {
+	r.register(commandId, handler{requestType: structType(request), invoke: h})
+}
+
+// HandleNotify is the same as Handle, but for notifications
+func (r *Router) HandleNotify(commandId uint32, request interface{}, h NotifyFunc) {
+	r.register(commandId, handler{requestType: structType(request), notify: h})
+}
+
+func (r *Router) register(commandId uint32, h handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.handlers[commandId] = h
+}
+
+func (r *Router) lookup(commandId uint32) (handler, bool) {
+	if r == nil {
+		return handler{}, false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	h, ok := r.handlers[commandId]
+	return h, ok
+}
+
+// Decodes the request right from the packet body and calls the matching
+// handler. Invokes which can't be served are answered with an error code and
+// an empty body, the same way the reference daemon does
+func (r *Router) receive(c *conn, head bucketHead, body io.Reader) {
+	h, ok := r.lookup(head.Command)
+	if !ok || (head.ReturnData && h.invoke == nil) {
+		// log.Println("Received packet", head.Command, "but did not handle :)")
+		r.fail(c, head, body, ReturnConnectionNoHandler)
+		return
+	}
+
+	request := reflect.New(h.requestType).Interface()
+	if err := portable.NewDecoder(body).Decode(request); err != nil {
+		log.Println("levin: unable to decode command", head.Command, err)
+		r.fail(c, head, body, ReturnFormatError)
+		return
+	}
+
+	// Handlers may invoke on this very connection, so they can't block the
+	// receive loop. At most maxHandlers of them run at once, and once all of
+	// them are busy the receive loop waits, which holds the peer back
+	select {
+	case c.handlers <- struct{}{}:
+	case <-c.closing:
+		return
+	}
+	go func() {
+		defer func() { <-c.handlers }()
+		r.serve(c, head, h, request)
+	}()
+}
+
+// Calls the handler and sends its response back through c
+func (r *Router) serve(c *conn, head bucketHead, h handler, request interface{}) {
+	if !head.ReturnData {
+		if h.notify != nil {
+			h.notify(c, request)
+		}
+		return
+	}
+
+	response, returnCode := h.invoke(c, request)
+	if response == nil {
+		return
+	}
+	if err := c.Respond(head.Command, returnCode, response); err != nil {
+		log.Println("levin: unable to respond to", head.Command, err)
+	}
+}
+
+// Answered right from the receive loop, as only a header is written. The rest
+// of the body is skipped first, so the peer is not stuck sending it while we
+// are sending the answer
+func (r *Router) fail(c *conn, head bucketHead, body io.Reader, code ReturnCode) {
+	if !head.ReturnData {
+		return
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return
+	}
+	if err := c.sendCommand(head.Command, nil, false, flagResponse, code); err != nil {
+		log.Println("levin: unable to respond to", head.Command, err)
+	}
+}
+
+func structType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
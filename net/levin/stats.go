@@ -0,0 +1,117 @@
+package levin
+
+import (
+	"time"
+)
+
+// CommandStats holds traffic counters of a single command. Sizes include
+// packet headers
+type CommandStats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+// Stats is a snapshot of connection counters
+type Stats struct {
+	Commands map[uint32]CommandStats
+	Total    CommandStats
+
+	Invokes       uint64        // Number of completed invokes
+	InvokeTime    time.Duration // Total time spent waiting for responses
+	MaxInvokeTime time.Duration
+	Timeouts      uint64
+
+	Connected    time.Time
+	LastActivity time.Time // Last time a packet was sent or received
+}
+
+// AverageInvokeTime returns the mean latency of completed invokes
+func (s *Stats) AverageInvokeTime() time.Duration {
+	if s.Invokes == 0 {
+		return 0
+	}
+	return s.InvokeTime / time.Duration(s.Invokes)
+}
+
+// Observer is notified about the traffic of a connection. Its methods are
+// called synchronously from the sending and receiving goroutines, so they
+// should return quickly
+type Observer interface {
+	PacketSent(c Conn, commandId uint32, size int)
+	PacketReceived(c Conn, commandId uint32, size int)
+	InvokeDone(c Conn, commandId uint32, latency time.Duration, err error)
+}
+
+func (c *conn) Stats() Stats {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	s := c.stats
+	s.Commands = make(map[uint32]CommandStats, len(c.stats.Commands))
+	for k, v := range c.stats.Commands {
+		s.Commands[k] = v
+	}
+	return s
+}
+
+func (c *conn) SetObserver(o Observer) {
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+
+	c.observer = o
+}
+
+func (c *conn) recordSent(commandId uint32, size int) {
+	c.statsMutex.Lock()
+	cs := c.stats.Commands[commandId]
+	cs.BytesOut += uint64(size)
+	cs.PacketsOut++
+	c.stats.Commands[commandId] = cs
+	c.stats.Total.BytesOut += uint64(size)
+	c.stats.Total.PacketsOut++
+	c.stats.LastActivity = time.Now()
+	o := c.observer
+	c.statsMutex.Unlock()
+
+	if o != nil {
+		o.PacketSent(c, commandId, size)
+	}
+}
+
+func (c *conn) recordReceived(commandId uint32, size int) {
+	c.statsMutex.Lock()
+	cs := c.stats.Commands[commandId]
+	cs.BytesIn += uint64(size)
+	cs.PacketsIn++
+	c.stats.Commands[commandId] = cs
+	c.stats.Total.BytesIn += uint64(size)
+	c.stats.Total.PacketsIn++
+	c.stats.LastActivity = time.Now()
+	o := c.observer
+	c.statsMutex.Unlock()
+
+	if o != nil {
+		o.PacketReceived(c, commandId, size)
+	}
+}
+
+func (c *conn) recordInvoke(commandId uint32, latency time.Duration, err error) {
+	c.statsMutex.Lock()
+	if err == ErrTimedOut {
+		c.stats.Timeouts++
+	} else if err == nil {
+		c.stats.Invokes++
+		c.stats.InvokeTime += latency
+		if latency > c.stats.MaxInvokeTime {
+			c.stats.MaxInvokeTime = latency
+		}
+	}
+	o := c.observer
+	c.statsMutex.Unlock()
+
+	if o != nil {
+		o.InvokeDone(c, commandId, latency, err)
+	}
+}
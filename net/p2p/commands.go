@@ -1,7 +1,11 @@
 package p2p
 
+//go:generate go run ../../cmd/portable-gen -o portable_gen.go commands.go structs.go
+
 const (
 	commandHandshakeId      = 1001
+	commandTimedSyncId      = 1002
+	commandPingId           = 1003
 	commandSupportedFlagsId = 1007
 )
 
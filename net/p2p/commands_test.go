@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
+)
+
+// Same layout as HandshakeResponse, but without generated methods, so it
+// goes through reflection
+type reflectiveHandshake struct {
+	Deprecated string `store:"local_peerlist"`
+	Peers      []struct {
+		Address struct {
+			Address struct {
+				Ip   uint32 `store:"m_ip"`
+				Port uint16 `store:"m_port"`
+			} `store:"addr"`
+			Type uint8 `store:"type"`
+		} `store:"adr"`
+		Id       uint64 `store:"id"`
+		LastSeen int64  `store:"last_seen"`
+	} `store:"local_peerlist_new"`
+	NodeData struct {
+		LocalTime uint64 `store:"local_time"`
+		MyPort    uint32 `store:"my_port"`
+		NetworkId string `store:"network_id"`
+		PeerId    uint64 `store:"peer_id"`
+	} `store:"node_data"`
+	SyncData struct {
+		CumulativeDifficulty uint64   `store:"cumulative_difficulty"`
+		CurrentHeight        uint64   `store:"current_height"`
+		TopId                [32]byte `store:"top_id"`
+		TopVersion           uint8    `store:"top_version"`
+	} `store:"payload_data"`
+}
+
+func testHandshakeResponse() *HandshakeResponse {
+	response := &HandshakeResponse{
+		NodeData: BasicNodeData{1532497695, 12560, "rnowflakenetwork", 0xeea786d5d86da9a1},
+		SyncData: CoreSyncData{CumulativeDifficulty: 723114898676, CurrentHeight: 145000, TopVersion: 7},
+	}
+	response.SyncData.TopId[0], response.SyncData.TopId[31] = 0xde, 0xad
+	for i := 0; i < 250; i++ {
+		ip := netip.AddrFrom4([4]byte{188, 35, byte(i >> 8), byte(i)})
+		response.Peers = append(response.Peers, PeerListEntry{
+			Address:  NewAddress(netip.AddrPortFrom(ip, 12560)),
+			Id:       uint64(i) * 0x9e3779b97f4a7c15,
+			LastSeen: 1532497695 - int64(i),
+		})
+	}
+	return response
+}
+
+func TestGeneratedCompatible(t *testing.T) {
+	response := testHandshakeResponse()
+	generated, err := portable.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirror := reflectiveHandshake{}
+	if err := portable.Unmarshal(generated, &mirror); err != nil {
+		t.Fatal(err)
+	}
+	reflective, err := portable.Marshal(&mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, reflective) {
+		t.Errorf("generated encoding differs:\n%x\n%x", generated, reflective)
+	}
+
+	out := &HandshakeResponse{}
+	if err := portable.Unmarshal(reflective, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(response, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", response, out)
+	}
+
+	// Missing entries and wrong types are reported like the reflective
+	// decoder does
+	s, _ := portable.UnmarshalSection(generated)
+	nodeData, _ := s.Section("node_data")
+	nodeData.Set("my_port", uint64(1)<<40)
+	data, _ := portable.MarshalSection(s)
+	if err := portable.Unmarshal(data, out); err != portable.ErrOverflow {
+		t.Errorf("err = %v, want %v", err, portable.ErrOverflow)
+	}
+	nodeData.Delete("my_port")
+	data, _ = portable.MarshalSection(s)
+	if err := portable.Unmarshal(data, out); err == nil {
+		t.Error("missing entry was not reported")
+	}
+}
+
+func BenchmarkMarshalGenerated(b *testing.B) {
+	response := testHandshakeResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := portable.Marshal(response); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalReflective(b *testing.B) {
+	data, _ := portable.Marshal(testHandshakeResponse())
+	mirror := &reflectiveHandshake{}
+	portable.Unmarshal(data, mirror)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := portable.Marshal(mirror); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalGenerated(b *testing.B) {
+	data, _ := portable.Marshal(testHandshakeResponse())
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := portable.Unmarshal(data, &HandshakeResponse{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalReflective(b *testing.B) {
+	data, _ := portable.Marshal(testHandshakeResponse())
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := portable.Unmarshal(data, &reflectiveHandshake{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/net/levin"
+)
+
+const (
+	pingOkStatus = "OK"
+
+	// Features announced in the support flags response. Fluffy blocks (0x01)
+	// are not implemented yet
+	supportFlags = 0
+)
+
+var (
+	ErrWrongNetwork   = errors.New("net/p2p: peer belongs to another network")
+	ErrSelfConnection = errors.New("net/p2p: connected to self")
+	ErrNoHandshake    = errors.New("net/p2p: peer has not handshaked")
+)
+
+// State of a connection which has passed the handshake. It is attached to the
+// connection context and guarded by Node.stateMutex
+type connectedPeer struct {
+	id       uint64
+	address  AddressType // Where the peer accepts connections, zero if unknown
+	syncData CoreSyncData
+}
+
+func (n *Node) registerHandlers() {
+	n.router.Handle(commandHandshakeId, HandshakeRequest{}, n.handleHandshake)
+	n.router.Handle(commandTimedSyncId, TimedSyncRequest{}, n.handleTimedSync)
+	n.router.Handle(commandPingId, PingRequest{}, n.handlePing)
+	n.router.Handle(commandSupportedFlagsId, SupportedFlagsRequest{}, n.handleSupportedFlags)
+}
+
+// Handshakes are accepted once and only from inbound connections. Anything
+// unexpected drops the connection without a response, the same way the
+// reference node does
+func (n *Node) handleHandshake(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+	req := request.(*HandshakeRequest)
+
+	if err := n.checkNodeData(&req.NodeData); err != nil {
+		log.Println("Rejecting handshake from", c.RemoteAddr(), err)
+		n.dropConnection(c)
+		return nil, 0
+	}
+
+	peer := &connectedPeer{
+		id:       req.NodeData.PeerId,
+		address:  publicAddress(c, req.NodeData.MyPort),
+		syncData: req.SyncData,
+	}
+	if !n.acceptPeer(c, peer) {
+		log.Println("Unexpected handshake from", c.RemoteAddr())
+		n.dropConnection(c)
+		return nil, 0
+	}
+	log.Println(c.RemoteAddr(), "has height", req.SyncData.CurrentHeight, "and difficulty", req.SyncData.CumulativeDifficulty)
+	if peer.address.AddrPort.IsValid() && isIpAllowed(peer.address.IpString()) {
+		n.spawn(func() { n.pingBack(*peer) })
+	}
+
+	return &HandshakeResponse{
+		Peers:    n.peers.GetPeerlistHead(peersPerHandshake),
+		NodeData: n.gatherNodeData(),
+		SyncData: n.gatherCoreSyncData(),
+	}, levin.ReturnOK
+}
+
+func (n *Node) handleTimedSync(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+	req := request.(*TimedSyncRequest)
+
+	if !n.updateSyncData(c, req.SyncData) {
+		log.Println("Timed sync before handshake from", c.RemoteAddr())
+		n.dropConnection(c)
+		return nil, 0
+	}
+
+	return &TimedSyncResponse{
+		LocalTime: uint64(time.Now().Unix()),
+		SyncData:  n.gatherCoreSyncData(),
+		Peers:     n.peers.GetPeerlistHead(peersPerHandshake),
+	}, levin.ReturnOK
+}
+
+// Checks that an inbound peer accepts connections on the port it has
+// announced. Only such peers are added to the white list, and so advertised
+// to others
+func (n *Node) pingBack(peer connectedPeer) {
+	ctx, cancel := context.WithTimeout(n.ctx, pingConnectionTimeout)
+	defer cancel()
+
+	c, err := levin.DialContext(ctx, peer.address.String(), nil)
+	if err != nil {
+		log.Println("Unable to ping back", peer.address.String(), err)
+		return
+	}
+	defer c.Close()
+	c.SetObserver(n.traffic)
+
+	response := &PingResponse{}
+	if _, err := c.InvokeContext(ctx, commandPingId, &PingRequest{}, response); err != nil {
+		log.Println("Unable to ping back", peer.address.String(), err)
+		return
+	}
+	if response.Status != pingOkStatus || response.PeerId != peer.id {
+		log.Println("Wrong ping response from", peer.address.String())
+		return
+	}
+	if n.ctx.Err() != nil {
+		// Peers are not promoted while the node is stopping
+		return
+	}
+	n.peers.SetPeerHandshaked(peer.address, peer.id)
+}
+
+// Pings are answered regardless of the handshake, since nodes use them to
+// check whether a freshly met peer accepts connections
+func (n *Node) handlePing(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+	return &PingResponse{Status: pingOkStatus, PeerId: n.peerId}, levin.ReturnOK
+}
+
+func (n *Node) handleSupportedFlags(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+	return &SupportedFlagsResponse{Flags: supportFlags}, levin.ReturnOK
+}
+
+// Checks that the remote node belongs to our network and is not us
+func (n *Node) checkNodeData(data *BasicNodeData) error {
+	if data.NetworkId != networkId {
+		return ErrWrongNetwork
+	}
+	if data.PeerId == n.peerId {
+		return ErrSelfConnection
+	}
+	return nil
+}
+
+// Moves a handshaked inbound connection from the passive ones to Ins. Fails
+// if c is not a passive connection or the node is stopping
+func (n *Node) acceptPeer(c levin.Conn, peer *connectedPeer) bool {
+	n.insMutex.Lock()
+	defer n.insMutex.Unlock()
+
+	address := c.RemoteAddr().String()
+	if n.passive[address] != c || n.ctx.Err() != nil {
+		return false
+	}
+	delete(n.passive, address)
+	n.Ins[address] = c
+	n.setConnectedPeer(c, peer)
+	return true
+}
+
+// Closes c and forgets it if it is an inbound connection. Outbound ones are
+// removed by kickIdlePeers once they are closed
+func (n *Node) dropConnection(c levin.Conn) {
+	address := c.RemoteAddr().String()
+
+	n.insMutex.Lock()
+	if n.passive[address] == c {
+		delete(n.passive, address)
+	}
+	if n.Ins[address] == c {
+		delete(n.Ins, address)
+	}
+	n.insMutex.Unlock()
+
+	c.Close()
+}
+
+func (n *Node) setConnectedPeer(c levin.Conn, peer *connectedPeer) {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+
+	*c.Context() = peer
+}
+
+// Returns a copy of the state of a handshaked connection
+func (n *Node) peerState(c levin.Conn) (connectedPeer, bool) {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+
+	peer, ok := (*c.Context()).(*connectedPeer)
+	if !ok {
+		return connectedPeer{}, false
+	}
+	return *peer, true
+}
+
+// Stores the latest sync data of a handshaked connection. Returns false if
+// the handshake has not been done yet
+func (n *Node) updateSyncData(c levin.Conn, data CoreSyncData) bool {
+	n.stateMutex.Lock()
+	defer n.stateMutex.Unlock()
+
+	peer, ok := (*c.Context()).(*connectedPeer)
+	if ok {
+		peer.syncData = data
+	}
+	return ok
+}
+
+// Combines the remote IP of c with the port the peer claims to listen on.
+// Returns zero address if the peer does not accept connections
+func publicAddress(c levin.Conn, port uint32) AddressType {
+	remote, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil || port == 0 || port > math.MaxUint16 {
+		return AddressType{}
+	}
+	return NewAddress(netip.AddrPortFrom(remote.Addr(), uint16(port)))
+}
+
+// Parses the address an outbound connection was made to
+func dialedAddress(address string) AddressType {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return AddressType{}
+	}
+	return NewAddress(addrPort)
+}
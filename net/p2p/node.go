@@ -2,10 +2,14 @@
 package p2p
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"log"
 	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -36,7 +40,12 @@ const (
 	idlePeerKickTime    = 10 * time.Minute
 	passivePeerKickTime = 1 * time.Minute
 
+	// Outbound connections alive for that long become anchors
+	anchorConnectionAge = 10 * time.Minute
+
 	networkId = "rnowflakenetwork"
+
+	peerlistFileName = "peerlist.bin"
 )
 
 type peerType uint8
@@ -56,55 +65,153 @@ var (
 	}
 )
 
-type Node struct {
-	// TODO: levin listener
-
-	Ins  map[string]levin.Conn
-	Outs map[string]levin.Conn
-
-	peers *peerlist
-
-	port   uint16
-	peerId uint64
+// Config holds node settings passed to StartNode
+type Config struct {
+	Port    uint16 // Incoming connections port
+	DataDir string // Where the peerlist is kept. Nothing is stored if empty
+}
 
-	stopIdleRoutine chan struct{}
-	wg              sync.WaitGroup
+type Node struct {
+	listener *levin.Listener
+	router   *levin.Router
+
+	Ins      map[string]levin.Conn
+	insMutex sync.Mutex // Ins are filled from the accept routine and handlers
+	Outs     map[string]levin.Conn
+
+	// Inbound connections waiting for the handshake, guarded by insMutex
+	passive map[string]levin.Conn
+	// Guards the connectedPeer attached to the connection contexts
+	stateMutex sync.Mutex
+
+	peers   *peerlist
+	traffic *traffic
+
+	port         uint16
+	peerId       uint64
+	peerlistPath string // Empty if the peerlist is not stored
+
+	// Cancelling ctx stops all node routines and pending handshakes
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	stopMutex sync.Mutex // orders goroutines started by spawn before Stop
 }
 
 // Start runs a node on given port and starts.
-// It also runs P2P maintenance routines which should be stopped with Stop
-func StartNode(port uint16) (*Node, error) {
+// It also runs P2P maintenance routines which are stopped either with Stop
+// or with cancellation of ctx. Stop should be called in both cases to close
+// the connections
+func StartNode(ctx context.Context, cfg Config) (*Node, error) {
 	n := &Node{
-		Ins:  make(map[string]levin.Conn),
-		Outs: make(map[string]levin.Conn),
+		Ins:     make(map[string]levin.Conn),
+		Outs:    make(map[string]levin.Conn),
+		passive: make(map[string]levin.Conn),
 
-		peers: NewPeerlist(),
+		peers:   NewPeerlist(),
+		traffic: newTraffic(),
+		router:  levin.NewRouter(),
 
-		port:   port,
+		port:   cfg.Port,
 		peerId: 0,
-
-		stopIdleRoutine: make(chan struct{}),
 	}
 	binary.Read(rand.Reader, binary.LittleEndian, &n.peerId)
 	log.Printf("Choosen PeerID: %x\n", n.peerId)
+	n.registerHandlers()
 
-	n.wg.Add(1)
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+			return nil, err
+		}
+		n.peerlistPath = filepath.Join(cfg.DataDir, peerlistFileName)
+		if err := n.peers.Load(n.peerlistPath); err != nil && !os.IsNotExist(err) {
+			// Peers will be taken from the seeds again
+			log.Println("Unable to load peerlist:", err)
+		}
+	}
+
+	listener, err := levin.Listen(":"+strconv.Itoa(int(cfg.Port)), n.router)
+	if err != nil {
+		return nil, err
+	}
+	n.listener = listener
+	n.ctx, n.cancel = context.WithCancel(ctx)
+
+	n.wg.Add(2)
+	go n.acceptRoutine()
 	go n.idleRoutine()
 
 	return n, nil
 }
 
-// Stop() will block until all open nodes are gracefully closed
+// Stop() will block until all open nodes are gracefully closed. The peerlist
+// is stored one last time
 func (n *Node) Stop() {
-	close(n.stopIdleRoutine)
+	n.stopMutex.Lock()
+	n.cancel()
+	n.stopMutex.Unlock()
 	n.wg.Wait()
+	n.storePeerlist()
 
 	for _, conn := range n.Outs {
 		conn.Close()
 	}
+
+	n.insMutex.Lock()
+	defer n.insMutex.Unlock()
 	for _, conn := range n.Ins {
 		conn.Close()
 	}
+	for _, conn := range n.passive {
+		conn.Close()
+	}
+}
+
+// Accepts incoming connections until the listener is closed. They stay
+// passive until the peer handshakes
+func (n *Node) acceptRoutine() {
+	defer n.wg.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-n.ctx.Done():
+			n.listener.Close()
+		case <-done:
+		}
+	}()
+
+	err := n.listener.Serve(func(conn levin.Conn) {
+		n.insMutex.Lock()
+		defer n.insMutex.Unlock()
+
+		if len(n.Ins)+len(n.passive) >= maxInConnections {
+			conn.Close()
+			return
+		}
+		conn.SetObserver(n.traffic)
+		n.passive[conn.RemoteAddr().String()] = conn
+	})
+	if n.ctx.Err() == nil {
+		log.Println("acceptRoutine:", err)
+	}
+}
+
+// Runs f in a goroutine which Stop waits for. Nothing is started once the
+// node is stopping
+func (n *Node) spawn(f func()) {
+	n.stopMutex.Lock()
+	defer n.stopMutex.Unlock()
+
+	if n.ctx.Err() != nil {
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
 }
 
 func (n *Node) idleRoutine() {
@@ -112,17 +219,78 @@ func (n *Node) idleRoutine() {
 
 	connMakerTicker := time.NewTicker(connMakerInterval)
 	defer connMakerTicker.Stop()
+	handshakeTicker := time.NewTicker(handshakeInterval)
+	defer handshakeTicker.Stop()
+	storeTicker := time.NewTicker(peerlistStoreInterval)
+	defer storeTicker.Stop()
 
 	for {
 		select {
 		case <-connMakerTicker.C:
+			n.kickIdlePeers()
 			n.makeConnections()
-		case <-n.stopIdleRoutine:
+		case <-handshakeTicker.C:
+			n.timedSync()
+		case <-storeTicker.C:
+			n.storePeerlist()
+		case <-n.ctx.Done():
 			return
 		}
 	}
 }
 
+func (n *Node) storePeerlist() {
+	if n.peerlistPath == "" {
+		return
+	}
+	if err := n.peers.Save(n.peerlistPath); err != nil {
+		log.Println("Unable to store peerlist:", err)
+	}
+}
+
+// Stats returns traffic counters aggregated over all connections the node
+// has ever had
+func (n *Node) Stats() levin.Stats {
+	return n.traffic.snapshot()
+}
+
+// Drops connections which are closed or have been idle for too long, and
+// inbound ones which have not handshaked in time
+func (n *Node) kickIdlePeers() {
+	isDead := func(conn levin.Conn) bool {
+		select {
+		case <-conn.Done():
+			return true
+		default:
+		}
+		return time.Since(conn.Stats().LastActivity) > idlePeerKickTime
+	}
+
+	for address, conn := range n.Outs {
+		if isDead(conn) {
+			log.Println("Dropping idle peer", address)
+			n.dropOutConnection(address)
+		}
+	}
+
+	n.insMutex.Lock()
+	defer n.insMutex.Unlock()
+	for address, conn := range n.Ins {
+		if isDead(conn) {
+			log.Println("Dropping idle peer", address)
+			conn.Close()
+			delete(n.Ins, address)
+		}
+	}
+	for address, conn := range n.passive {
+		if isDead(conn) || time.Since(conn.Stats().Connected) > passivePeerKickTime {
+			log.Println("Dropping passive peer", address)
+			conn.Close()
+			delete(n.passive, address)
+		}
+	}
+}
+
 func (n *Node) makeConnections() {
 	log.Println("makeConnections")
 
@@ -173,9 +341,15 @@ connLoop:
 	for connCount < targetCount {
 		switch kind {
 		case anchorPeer:
-			break connLoop
+			log.Println("Trying anchor peer")
+			if !n.makeConnectionFromAnchorPeerlist() {
+				break connLoop
+			}
 		case whitePeer:
-			break connLoop
+			log.Println("Trying white peer")
+			if !n.makeConnectionFromWhitePeerlist() {
+				break connLoop
+			}
 		case grayPeer:
 			log.Println("Trying gray peer")
 			if !n.makeConnectionFromGrayPeerlist() {
@@ -187,6 +361,60 @@ connLoop:
 	}
 }
 
+// Tries anchor peers in random order until one of them accepts. Anchors which
+// can't be reached are forgotten
+func (n *Node) makeConnectionFromAnchorPeerlist() bool {
+	for _, peer := range n.peers.GetAnchorPeers() {
+		if _, present := n.Outs[peer.Address.String()]; present || peer.Address.IsOnion() {
+			continue
+		}
+
+		log.Println("Trying to connect to ANCHOR peer:", peer.Address.String())
+		if n.connectAndHandshakeWithPeer(peer.Address.String(), false) {
+			return true
+		}
+		n.peers.RemoveAnchorPeer(peer.Address)
+	}
+
+	return false
+}
+
+func (n *Node) makeConnectionFromWhitePeerlist() bool {
+	peerCount := n.peers.WhiteCount()
+	if peerCount == 0 {
+		return false
+	}
+
+	triedPeers := make(map[string]struct{})
+	tryConnect := 0
+	tryChoose := 0
+	for tryChoose < 3*min(peerCount, 20) && tryConnect < 10 {
+		tryChoose++
+
+		peer, ok := n.peers.GetRandomWhitePeer()
+		if !ok || peer.Address.IsOnion() {
+			continue
+		}
+		if _, present := n.Outs[peer.Address.String()]; present {
+			continue
+		}
+		if _, present := triedPeers[peer.Address.String()]; present {
+			continue
+		}
+
+		tryConnect++
+		triedPeers[peer.Address.String()] = struct{}{}
+
+		log.Println("Trying to connect to WHITE peer:", peer.Address.String())
+		log.Println("Last seen:", formatTimeSince(peer.LastSeen), "ago")
+		if n.connectAndHandshakeWithPeer(peer.Address.String(), false) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (n *Node) makeConnectionFromGrayPeerlist() bool {
 	peerCount := n.peers.GrayCount()
 	if peerCount == 0 {
@@ -209,19 +437,24 @@ func (n *Node) makeConnectionFromGrayPeerlist() bool {
 		if _, present := triedPeers[peer.Address.String()]; present {
 			continue
 		}
-
-		tryConnect++
 		triedPeers[peer.Address.String()] = struct{}{}
 
-		// TODO: Check if host not allowed or failed recently
+		if peer.Address.IsOnion() || !isIpAllowed(peer.Address.IpString()) {
+			continue
+		}
+		if n.peers.IsRecentlyFailed(peer.Address) {
+			continue
+		}
+		tryConnect++
 
 		log.Println("Trying to connect to GRAY peer:", peer.Address.String())
 		log.Println("Last seen:", formatTimeSince(peer.LastSeen), "ago")
-		// if !connectAndHandshakeWithPeer(peer.Address.String(), false) {
-		// 	continue
-		// }
+		if !n.connectAndHandshakeWithPeer(peer.Address.String(), false) {
+			n.peers.RecordFailure(peer.Address)
+			continue
+		}
 
-		return false
+		return true
 	}
 
 	return false
@@ -241,17 +474,23 @@ func (n *Node) connectAndHandshakeWithPeer(address string, onlyTakePeerList bool
 
 	log.Println("Attempting to connect to", address)
 
-	out, err := levin.Dial(address)
+	dialCtx, cancel := context.WithTimeout(n.ctx, connectionTimeout)
+	out, err := levin.DialContext(dialCtx, address, n.router)
+	cancel()
 	if err != nil {
 		log.Println("Unable to connect:", address, err)
 		return false
 	}
+	out.SetObserver(n.traffic)
 	n.Outs[address] = out
 	if onlyTakePeerList {
 		defer n.dropOutConnection(address)
 	}
 
 	response, err := n.handshakeWithPeer(out)
+	if err == nil {
+		err = n.checkNodeData(&response.NodeData)
+	}
 	if err != nil {
 		if !onlyTakePeerList {
 			defer n.dropOutConnection(address)
@@ -261,6 +500,15 @@ func (n *Node) connectAndHandshakeWithPeer(address string, onlyTakePeerList bool
 	}
 
 	// log.Printf("%+v\n", response)
+	peer := &connectedPeer{
+		id:       response.NodeData.PeerId,
+		address:  dialedAddress(address),
+		syncData: response.SyncData,
+	}
+	n.setConnectedPeer(out, peer)
+	if !onlyTakePeerList && peer.address.AddrPort.IsValid() {
+		n.peers.SetPeerHandshaked(peer.address, peer.id)
+	}
 	log.Println(address, "answered with", len(response.Peers), "gray peers")
 	log.Println(address, "has height", response.SyncData.CurrentHeight, "and difficulty", response.SyncData.CumulativeDifficulty)
 
@@ -272,16 +520,104 @@ func (n *Node) connectAndHandshakeWithPeer(address string, onlyTakePeerList bool
 
 func (n *Node) handshakeWithPeer(peer levin.Conn) (*HandshakeResponse, error) {
 	response := &HandshakeResponse{}
-	_, err := peer.Invoke(
+	ctx, cancel := context.WithTimeout(n.ctx, handshakeTimeout)
+	defer cancel()
+
+	_, err := peer.InvokeContext(
+		ctx,
 		commandHandshakeId,
 		&HandshakeRequest{
 			NodeData: n.gatherNodeData(),
 			SyncData: n.gatherCoreSyncData()},
-		response,
-		invokeTimeout)
+		response)
 	return response, err
 }
 
+// Runs timed sync with every handshaked connection at once and drops the
+// ones which fail to answer in time
+func (n *Node) timedSync() {
+	type target struct {
+		address  string
+		conn     levin.Conn
+		outbound bool
+		err      error
+	}
+
+	var targets []*target
+	for address, conn := range n.Outs {
+		targets = append(targets, &target{address: address, conn: conn, outbound: true})
+	}
+	n.insMutex.Lock()
+	for address, conn := range n.Ins {
+		targets = append(targets, &target{address: address, conn: conn})
+	}
+	n.insMutex.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for _, t := range targets {
+		go func(t *target) {
+			defer wg.Done()
+			t.err = n.timedSyncWithPeer(t.conn)
+		}(t)
+	}
+	wg.Wait()
+
+	for _, t := range targets {
+		if t.err == nil {
+			if t.outbound {
+				n.promoteToAnchor(t.conn)
+			}
+			continue
+		}
+		log.Println("Timed sync with", t.address, "failed:", t.err)
+		if t.outbound {
+			n.dropOutConnection(t.address)
+		} else {
+			n.dropConnection(t.conn)
+		}
+	}
+}
+
+func (n *Node) timedSyncWithPeer(peer levin.Conn) error {
+	response := &TimedSyncResponse{}
+	ctx, cancel := context.WithTimeout(n.ctx, handshakeTimeout)
+	defer cancel()
+
+	_, err := peer.InvokeContext(
+		ctx,
+		commandTimedSyncId,
+		&TimedSyncRequest{SyncData: n.gatherCoreSyncData()},
+		response)
+	if err != nil {
+		return err
+	}
+
+	state, ok := n.peerState(peer)
+	if !ok {
+		return ErrNoHandshake
+	}
+	n.updateSyncData(peer, response.SyncData)
+	n.peers.MergePeerlist(response.Peers, int64(response.LocalTime))
+	n.peers.SetPeerJustSeen(state.address, state.id)
+	return nil
+}
+
+// Outbound connections which have lived long enough are restored first after
+// restart
+func (n *Node) promoteToAnchor(c levin.Conn) {
+	connected := c.Stats().Connected
+	state, ok := n.peerState(c)
+	if !ok || !state.address.AddrPort.IsValid() || time.Since(connected) < anchorConnectionAge {
+		return
+	}
+	n.peers.AddAnchorPeer(AnchorPeerListEntry{
+		Address:   state.address,
+		Id:        state.id,
+		FirstSeen: connected.Unix(),
+	})
+}
+
 // Drop n randomly picked connections
 func (n *Node) dropOutConnections(count uint) {
 	for i := uint(0); i < count; i++ {
@@ -323,9 +659,8 @@ func (n *Node) dropOutConnection(address string) {
 }
 
 func (n *Node) gatherNodeData() BasicNodeData {
-	localTime := uint64(0)
 	return BasicNodeData{
-		LocalTime: localTime,
+		LocalTime: uint64(time.Now().Unix()),
 		MyPort:    uint32(n.port),
 		NetworkId: networkId,
 		PeerId:    n.peerId,
@@ -333,5 +668,5 @@ func (n *Node) gatherNodeData() BasicNodeData {
 }
 
 func (n *Node) gatherCoreSyncData() CoreSyncData {
-	return CoreSyncData{0, 0, "", 0}
+	return CoreSyncData{}
 }
@@ -0,0 +1,302 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/net/levin"
+)
+
+// Starts a node on a random port and dials it
+func startTestNode(t *testing.T) (*Node, levin.Conn) {
+	t.Helper()
+	n, err := StartNode(context.Background(), Config{Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Stop)
+
+	port := n.listener.Addr().(*net.TCPAddr).Port
+	c, err := levin.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return n, c
+}
+
+func testNodeData(peerId uint64) BasicNodeData {
+	return BasicNodeData{
+		LocalTime: uint64(time.Now().Unix()),
+		MyPort:    12560,
+		NetworkId: networkId,
+		PeerId:    peerId,
+	}
+}
+
+func insCount(n *Node) int {
+	n.insMutex.Lock()
+	defer n.insMutex.Unlock()
+	return len(n.Ins)
+}
+
+func TestInboundHandshake(t *testing.T) {
+	n, c := startTestNode(t)
+
+	// Nothing but ping is served before the handshake
+	ping := &PingResponse{}
+	if _, err := c.Invoke(commandPingId, &PingRequest{}, ping, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ping.Status != pingOkStatus || ping.PeerId != n.peerId {
+		t.Fatalf("unexpected ping response %+v", ping)
+	}
+	if insCount(n) != 0 {
+		t.Fatal("peer is registered before the handshake")
+	}
+
+	request := &HandshakeRequest{
+		NodeData: testNodeData(n.peerId + 1),
+		SyncData: CoreSyncData{CurrentHeight: 42},
+	}
+	response := &HandshakeResponse{}
+	if _, err := c.Invoke(commandHandshakeId, request, response, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if response.NodeData.PeerId != n.peerId || response.NodeData.NetworkId != networkId {
+		t.Fatalf("unexpected node data %+v", response.NodeData)
+	}
+	if insCount(n) != 1 {
+		t.Fatal("peer is not registered after the handshake")
+	}
+
+	sync := &TimedSyncResponse{}
+	if _, err := c.Invoke(commandTimedSyncId, &TimedSyncRequest{SyncData: CoreSyncData{CurrentHeight: 43}}, sync, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if sync.LocalTime == 0 {
+		t.Fatal("timed sync response has no local time")
+	}
+
+	flags := &SupportedFlagsResponse{}
+	if _, err := c.Invoke(commandSupportedFlagsId, &SupportedFlagsRequest{}, flags, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if flags.Flags != supportFlags {
+		t.Fatalf("unexpected flags %x", flags.Flags)
+	}
+
+	// Second handshake on the same connection is a protocol violation
+	if _, err := c.Invoke(commandHandshakeId, request, response, time.Second); err == nil {
+		t.Fatal("repeated handshake succeeded")
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not dropped")
+	}
+}
+
+func TestRejectedHandshake(t *testing.T) {
+	tests := map[string]func(n *Node) BasicNodeData{
+		"wrong network": func(n *Node) BasicNodeData {
+			data := testNodeData(n.peerId + 1)
+			data.NetworkId = "someothernetwork"
+			return data
+		},
+		"self": func(n *Node) BasicNodeData {
+			return testNodeData(n.peerId)
+		},
+	}
+	for name, nodeData := range tests {
+		t.Run(name, func(t *testing.T) {
+			n, c := startTestNode(t)
+
+			request := &HandshakeRequest{NodeData: nodeData(n)}
+			if _, err := c.Invoke(commandHandshakeId, request, &HandshakeResponse{}, time.Second); err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Fatal("connection is not dropped")
+			}
+			if insCount(n) != 0 {
+				t.Fatal("rejected peer is registered")
+			}
+		})
+	}
+}
+
+func TestTimedSyncBeforeHandshake(t *testing.T) {
+	_, c := startTestNode(t)
+
+	if _, err := c.Invoke(commandTimedSyncId, &TimedSyncRequest{}, &TimedSyncResponse{}, time.Second); err == nil {
+		t.Fatal("timed sync succeeded before the handshake")
+	}
+}
+
+// Handshakes with n on c, so that n syncs with c periodically
+func handshakeTestNode(t *testing.T, n *Node, c levin.Conn) levin.Conn {
+	t.Helper()
+	request := &HandshakeRequest{NodeData: testNodeData(n.peerId + 1)}
+	if _, err := c.Invoke(commandHandshakeId, request, &HandshakeResponse{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	n.insMutex.Lock()
+	defer n.insMutex.Unlock()
+	for _, in := range n.Ins {
+		return in
+	}
+	t.Fatal("peer is not registered after the handshake")
+	return nil
+}
+
+func TestTimedSync(t *testing.T) {
+	n, err := StartNode(context.Background(), Config{Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	address := n.listener.Addr().(*net.TCPAddr)
+
+	now := time.Now().Unix()
+	router := levin.NewRouter()
+	router.Handle(commandTimedSyncId, TimedSyncRequest{},
+		func(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+			return &TimedSyncResponse{
+				LocalTime: uint64(now),
+				SyncData:  CoreSyncData{CurrentHeight: 100},
+				Peers: []PeerListEntry{{
+					Address:  NewAddress(netip.MustParseAddrPort("203.0.113.1:12560")),
+					Id:       1,
+					LastSeen: now - 10,
+				}},
+			}, levin.ReturnOK
+		})
+	failing := levin.NewRouter()
+	failing.Handle(commandTimedSyncId, TimedSyncRequest{},
+		func(c levin.Conn, request interface{}) (interface{}, levin.ReturnCode) {
+			return &TimedSyncResponse{}, levin.ReturnFormatError
+		})
+
+	dial := func(router *levin.Router) levin.Conn {
+		c, err := levin.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(address.Port)), router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+	good := handshakeTestNode(t, n, dial(router))
+	bad := dial(failing)
+	if _, err := bad.Invoke(commandHandshakeId, &HandshakeRequest{NodeData: testNodeData(n.peerId + 2)}, &HandshakeResponse{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	n.timedSync()
+
+	state, ok := n.peerState(good)
+	if !ok || state.syncData.CurrentHeight != 100 {
+		t.Fatalf("sync data is not updated: %+v", state.syncData)
+	}
+	if n.peers.GrayCount() != 1 {
+		t.Fatal("returned peers are not merged")
+	}
+	if insCount(n) != 1 {
+		t.Fatal("failing peer is not dropped")
+	}
+	select {
+	case <-bad.Done():
+	case <-time.After(time.Second):
+		t.Fatal("failing peer is not disconnected")
+	}
+}
+
+func TestPeerPromotion(t *testing.T) {
+	remote, _ := startTestNode(t)
+	n, _ := startTestNode(t)
+	port := uint16(remote.listener.Addr().(*net.TCPAddr).Port)
+	address := NewAddress(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port))
+
+	n.pingBack(connectedPeer{id: remote.peerId + 1, address: address})
+	if n.peers.WhiteCount() != 0 {
+		t.Fatal("peer with a wrong id is promoted")
+	}
+	n.pingBack(connectedPeer{id: remote.peerId, address: address})
+	if n.peers.WhiteCount() != 1 {
+		t.Fatal("pinged back peer is not promoted")
+	}
+
+	n.peers.whitePeers = make(map[string]PeerListEntry)
+	n.peers.grayPeers[address.String()] = PeerListEntry{Address: address}
+	if !n.connectAndHandshakeWithPeer(address.String(), false) {
+		t.Fatal("unable to connect")
+	}
+	if n.peers.GrayCount() != 0 || n.peers.WhiteCount() != 1 {
+		t.Fatal("handshaked peer is not promoted")
+	}
+	head := n.peers.GetPeerlistHead(peersPerHandshake)
+	if len(head) != 1 || head[0].Id != remote.peerId {
+		t.Fatalf("unexpected peerlist head %+v", head)
+	}
+}
+
+// Connection which is only good for promoteToAnchor
+type agedConn struct {
+	levin.Conn
+	context   interface{}
+	connected time.Time
+}
+
+func (c *agedConn) Context() *interface{} {
+	return &c.context
+}
+
+func (c *agedConn) Stats() levin.Stats {
+	return levin.Stats{Connected: c.connected}
+}
+
+func TestAnchorPromotion(t *testing.T) {
+	n := &Node{peers: NewPeerlist()}
+	old := time.Now().Add(-anchorConnectionAge - time.Minute)
+
+	conn := func(port uint16, connected time.Time) *agedConn {
+		c := &agedConn{connected: connected}
+		n.setConnectedPeer(c, &connectedPeer{
+			id:      uint64(port),
+			address: NewAddress(netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), port)),
+		})
+		return c
+	}
+
+	n.promoteToAnchor(conn(1, time.Now()))
+	n.promoteToAnchor(&agedConn{connected: old})
+	if anchors := n.peers.GetAnchorPeers(); len(anchors) != 0 {
+		t.Fatalf("young or not handshaked peers are promoted: %+v", anchors)
+	}
+
+	first := conn(2, old)
+	n.promoteToAnchor(first)
+	for port := uint16(3); port < 3+anchorConnectionsCount; port++ {
+		n.promoteToAnchor(conn(port, old))
+	}
+	anchors := n.peers.GetAnchorPeers()
+	if len(anchors) != anchorConnectionsCount {
+		t.Fatalf("%d anchors are kept, limit is %d", len(anchors), anchorConnectionsCount)
+	}
+
+	// Promoting again keeps the entry
+	first.connected = time.Now().Add(-2 * anchorConnectionAge)
+	n.promoteToAnchor(first)
+	for _, anchor := range n.peers.GetAnchorPeers() {
+		if anchor.Id == 2 && anchor.FirstSeen != old.Unix() {
+			t.Error("first seen time of an anchor is changed")
+		}
+	}
+}
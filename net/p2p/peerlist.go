@@ -1,20 +1,51 @@
 package p2p
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
 )
 
 const (
 	whitePeerlistLimit = 1000
 	grayPeerlistLimit  = 5000
+
+	// Failed addresses are not dialed again for that long
+	failedAddrForgetTime = 5 * time.Minute
+	// Gray peers are evicted after that many failed attempts in a row
+	grayPeerMaxFailures = 3
+
+	peerlistVersion = 1
 )
 
+var ErrPeerlistVersion = errors.New("net/p2p: unsupported peerlist version")
+
+// On-disk layout of the peerlist. Failures are not kept
+type peerlistState struct {
+	Version uint32                `store:"version"`
+	White   []PeerListEntry       `store:"white,omitempty"`
+	Gray    []PeerListEntry       `store:"gray,omitempty"`
+	Anchor  []AnchorPeerListEntry `store:"anchor,omitempty"`
+}
+
 type peerlist struct {
 	mutex sync.Mutex // prevent public access to the lock
 
 	grayPeers   map[string]PeerListEntry
 	whitePeers  map[string]PeerListEntry
 	anchorPeers map[string]AnchorPeerListEntry
+
+	failures map[string]peerFailure // failed connection attempts by address
+}
+
+type peerFailure struct {
+	count int
+	last  time.Time
 }
 
 func NewPeerlist() *peerlist {
@@ -22,6 +53,7 @@ func NewPeerlist() *peerlist {
 		grayPeers:   make(map[string]PeerListEntry),
 		whitePeers:  make(map[string]PeerListEntry),
 		anchorPeers: make(map[string]AnchorPeerListEntry),
+		failures:    make(map[string]peerFailure),
 	}
 }
 
@@ -53,6 +85,89 @@ func (p *peerlist) MergePeerlist(newPeers []PeerListEntry, localTime int64) {
 	p.addGrayPeers(peers)
 }
 
+// GetPeerlistHead returns up to count white peers, most recently seen first.
+// This is what the node advertises to others
+func (p *peerlist) GetPeerlistHead(count int) []PeerListEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	peers := make([]PeerListEntry, 0, len(p.whitePeers))
+	for _, v := range p.whitePeers {
+		peers = append(peers, v)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen > peers[j].LastSeen
+	})
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// SetPeerHandshaked moves a peer which has proven to be reachable from the gray
+// list to the white one. The least recently seen white peer is evicted if the
+// list is full
+func (p *peerlist) SetPeerHandshaked(address AddressType, id uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	node := address.String()
+	delete(p.grayPeers, node)
+	delete(p.failures, node)
+	if _, present := p.whitePeers[node]; !present && len(p.whitePeers) >= whitePeerlistLimit {
+		p.evictOldestWhitePeer()
+	}
+	p.whitePeers[node] = PeerListEntry{
+		Address:  address,
+		Id:       id,
+		LastSeen: time.Now().Unix(),
+	}
+}
+
+// RecordFailure notes a failed connection attempt. Gray peers which fail too
+// many times in a row are evicted
+func (p *peerlist) RecordFailure(address AddressType) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	node := address.String()
+	failure := p.failures[node]
+	failure.count++
+	failure.last = time.Now()
+	p.failures[node] = failure
+
+	if failure.count >= grayPeerMaxFailures {
+		delete(p.grayPeers, node)
+		delete(p.failures, node)
+	}
+}
+
+// IsRecentlyFailed tells whether the last connection attempt to address has
+// failed not long ago
+func (p *peerlist) IsRecentlyFailed(address AddressType) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	failure, present := p.failures[address.String()]
+	return present && time.Since(failure.last) < failedAddrForgetTime
+}
+
+// SetPeerJustSeen refreshes the last seen time of a white peer. Peers which
+// are not white are left as is
+func (p *peerlist) SetPeerJustSeen(address AddressType, id uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	node := address.String()
+	peer, present := p.whitePeers[node]
+	if !present {
+		return
+	}
+	peer.Id = id
+	peer.LastSeen = time.Now().Unix()
+	p.whitePeers[node] = peer
+}
+
 func (p *peerlist) GetRandomWhitePeer() (PeerListEntry, bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -93,6 +208,124 @@ func (p *peerlist) GetRandomGrayPeer() (PeerListEntry, bool) {
 	return PeerListEntry{}, false
 }
 
+// AddAnchorPeer remembers an outbound connection worth restoring first. The
+// first seen time of known anchors is kept. Only anchorConnectionsCount
+// anchors are kept, new ones are ignored until an old one is removed
+func (p *peerlist) AddAnchorPeer(peer AnchorPeerListEntry) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	node := peer.Address.String()
+	if old, present := p.anchorPeers[node]; present {
+		peer.FirstSeen = old.FirstSeen
+	} else if len(p.anchorPeers) >= anchorConnectionsCount {
+		return
+	}
+	p.anchorPeers[node] = peer
+}
+
+func (p *peerlist) RemoveAnchorPeer(address AddressType) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.anchorPeers, address.String())
+}
+
+func (p *peerlist) GetAnchorPeers() []AnchorPeerListEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	peers := make([]AnchorPeerListEntry, 0, len(p.anchorPeers))
+	for _, v := range p.anchorPeers {
+		peers = append(peers, v)
+	}
+	return peers
+}
+
+// Save writes the peerlist to path. The data goes to a temporary file first,
+// which then replaces the old one, so a crash never leaves a torn file behind
+func (p *peerlist) Save(path string) error {
+	p.mutex.Lock()
+	state := &peerlistState{Version: peerlistVersion}
+	for _, v := range p.whitePeers {
+		state.White = append(state.White, v)
+	}
+	for _, v := range p.grayPeers {
+		state.Gray = append(state.Gray, v)
+	}
+	for _, v := range p.anchorPeers {
+		state.Anchor = append(state.Anchor, v)
+	}
+	p.mutex.Unlock()
+
+	data, err := portable.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Load replaces the peerlist with the one saved at path
+func (p *peerlist) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	state := &peerlistState{}
+	if err := portable.Unmarshal(data, state); err != nil {
+		return err
+	}
+	if state.Version != peerlistVersion {
+		return ErrPeerlistVersion
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.whitePeers = make(map[string]PeerListEntry, len(state.White))
+	for _, v := range state.White {
+		p.whitePeers[v.Address.String()] = v
+	}
+	p.trimPeers(p.whitePeers, whitePeerlistLimit)
+	p.grayPeers = make(map[string]PeerListEntry, len(state.Gray))
+	p.addGrayPeers(state.Gray)
+	p.anchorPeers = make(map[string]AnchorPeerListEntry, len(state.Anchor))
+	for _, v := range state.Anchor {
+		if len(p.anchorPeers) < anchorConnectionsCount {
+			p.anchorPeers[v.Address.String()] = v
+		}
+	}
+	return nil
+}
+
+func (p *peerlist) evictOldestWhitePeer() {
+	oldest := ""
+	for node, v := range p.whitePeers {
+		if oldest == "" || v.LastSeen < p.whitePeers[oldest].LastSeen {
+			oldest = node
+		}
+	}
+	delete(p.whitePeers, oldest)
+	delete(p.failures, oldest)
+}
+
 func (p *peerlist) addGrayPeers(peers []PeerListEntry) {
 	for i := 0; i < len(peers); i++ {
 		node := peers[i].Address.String()
@@ -111,4 +344,24 @@ func (p *peerlist) addGrayPeers(peers []PeerListEntry) {
 			p.grayPeers[node] = peers[i]
 		}
 	}
+	p.trimPeers(p.grayPeers, grayPeerlistLimit)
+}
+
+// Evicts the least recently seen peers until at most limit are left, along
+// with their failures
+func (p *peerlist) trimPeers(peers map[string]PeerListEntry, limit int) {
+	if len(peers) <= limit {
+		return
+	}
+	nodes := make([]string, 0, len(peers))
+	for node := range peers {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return peers[nodes[i]].LastSeen < peers[nodes[j]].LastSeen
+	})
+	for _, node := range nodes[:len(nodes)-limit] {
+		delete(peers, node)
+		delete(p.failures, node)
+	}
 }
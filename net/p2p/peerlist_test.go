@@ -0,0 +1,213 @@
+package p2p
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
+)
+
+func TestPeerFailures(t *testing.T) {
+	p := NewPeerlist()
+	address := NewAddress(netip.MustParseAddrPort("203.0.113.1:12560"))
+	p.MergePeerlist([]PeerListEntry{{Address: address, Id: 1}}, time.Now().Unix())
+	if p.GrayCount() != 1 {
+		t.Fatal("peer is not merged")
+	}
+
+	if p.IsRecentlyFailed(address) {
+		t.Fatal("fresh peer is reported as failed")
+	}
+	for i := 1; i < grayPeerMaxFailures; i++ {
+		p.RecordFailure(address)
+		if !p.IsRecentlyFailed(address) {
+			t.Fatal("failure is not recorded")
+		}
+		if p.GrayCount() != 1 {
+			t.Fatal("peer is evicted too early")
+		}
+	}
+	p.RecordFailure(address)
+	if p.GrayCount() != 0 {
+		t.Fatal("failing peer is not evicted")
+	}
+	if p.IsRecentlyFailed(address) {
+		t.Fatal("failures of evicted peer are kept")
+	}
+
+	// Success clears the failures
+	p.MergePeerlist([]PeerListEntry{{Address: address, Id: 1}}, time.Now().Unix())
+	p.RecordFailure(address)
+	p.SetPeerHandshaked(address, 1)
+	if p.IsRecentlyFailed(address) || p.WhiteCount() != 1 || p.GrayCount() != 0 {
+		t.Fatal("handshaked peer is not promoted")
+	}
+}
+
+func TestDisallowedGrayPeer(t *testing.T) {
+	n, _ := startTestNode(t)
+	address := NewAddress(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), n.port))
+	n.peers.grayPeers[address.String()] = PeerListEntry{Address: address}
+
+	if n.makeConnectionFromGrayPeerlist() {
+		t.Fatal("connected to a disallowed peer")
+	}
+	if n.peers.IsRecentlyFailed(address) {
+		t.Fatal("disallowed peer has been dialed")
+	}
+}
+
+func TestPeerlistStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), peerlistFileName)
+	white := NewAddress(netip.MustParseAddrPort("203.0.113.1:12560"))
+	gray := NewAddress(netip.MustParseAddrPort("[2001:db8::1]:12560"))
+	now := time.Now().Unix()
+
+	p := NewPeerlist()
+	p.MergePeerlist([]PeerListEntry{{Address: gray, Id: 2, LastSeen: now - 10}}, now)
+	p.SetPeerHandshaked(white, 1)
+	p.AddAnchorPeer(AnchorPeerListEntry{Address: white, Id: 1, FirstSeen: now})
+	if err := p.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewPeerlist()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.whitePeers, p.whitePeers) ||
+		!reflect.DeepEqual(loaded.grayPeers, p.grayPeers) ||
+		!reflect.DeepEqual(loaded.anchorPeers, p.anchorPeers) {
+		t.Fatal("loaded peerlist differs from the saved one")
+	}
+
+	// Saving again replaces the file
+	if err := NewPeerlist().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.WhiteCount() != 0 || loaded.GrayCount() != 0 {
+		t.Fatal("old peerlist is loaded")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatal("temporary files are left behind")
+	}
+
+	data, _ := portable.Marshal(&peerlistState{Version: peerlistVersion + 1})
+	os.WriteFile(path, data, 0600)
+	if err := loaded.Load(path); err != ErrPeerlistVersion {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestNodePeerlistStore(t *testing.T) {
+	dir := t.TempDir()
+	address := NewAddress(netip.MustParseAddrPort("203.0.113.1:12560"))
+
+	n, err := StartNode(context.Background(), Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.peers.MergePeerlist([]PeerListEntry{{Address: address, Id: 1}}, time.Now().Unix())
+	n.Stop()
+
+	n, err = StartNode(context.Background(), Config{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	if n.peers.GrayCount() != 1 {
+		t.Fatal("peerlist is not restored")
+	}
+}
+
+func TestGrayPeerlistLimit(t *testing.T) {
+	now := time.Now().Unix()
+	peers := make([]PeerListEntry, grayPeerlistLimit+100)
+	for i := range peers {
+		ip := netip.AddrFrom4([4]byte{203, 0, byte(i >> 8), byte(i)})
+		peers[i] = PeerListEntry{
+			Address:  NewAddress(netip.AddrPortFrom(ip, 12560)),
+			Id:       uint64(i),
+			LastSeen: now - int64(len(peers)-i), // later peers are fresher
+		}
+	}
+
+	p := NewPeerlist()
+	p.MergePeerlist(peers[:grayPeerlistLimit], now)
+	p.MergePeerlist(peers[grayPeerlistLimit:], now)
+	if p.GrayCount() != grayPeerlistLimit {
+		t.Fatalf("gray list has %d peers, limit is %d", p.GrayCount(), grayPeerlistLimit)
+	}
+	for _, peer := range peers[:100] {
+		if _, present := p.grayPeers[peer.Address.String()]; present {
+			t.Fatal("not the oldest peers are evicted")
+		}
+	}
+
+	// Lists saved before the limit was enforced are trimmed on load
+	path := filepath.Join(t.TempDir(), peerlistFileName)
+	data, err := portable.Marshal(&peerlistState{Version: peerlistVersion, Gray: peers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if p.GrayCount() != grayPeerlistLimit {
+		t.Fatalf("loaded gray list has %d peers, limit is %d", p.GrayCount(), grayPeerlistLimit)
+	}
+}
+
+func TestEvictedPeerFailures(t *testing.T) {
+	now := time.Now().Unix()
+	address := func(i int) AddressType {
+		return NewAddress(netip.AddrPortFrom(netip.AddrFrom4([4]byte{203, 0, byte(i >> 8), byte(i)}), 12560))
+	}
+
+	p := NewPeerlist()
+	peers := make([]PeerListEntry, grayPeerlistLimit)
+	for i := range peers {
+		peers[i] = PeerListEntry{Address: address(i), Id: uint64(i), LastSeen: now - int64(len(peers)-i)}
+	}
+	p.MergePeerlist(peers, now)
+	for _, peer := range peers[:100] {
+		p.RecordFailure(peer.Address)
+	}
+	if len(p.failures) != 100 {
+		t.Fatalf("%d failures are recorded, want 100", len(p.failures))
+	}
+	fresh := make([]PeerListEntry, 100)
+	for i := range fresh {
+		fresh[i] = PeerListEntry{Address: address(len(peers) + i), LastSeen: now}
+	}
+	p.MergePeerlist(fresh, now)
+	if len(p.failures) != 0 {
+		t.Fatalf("failures of %d evicted gray peers are kept", len(p.failures))
+	}
+
+	// White peers evicted to make room for a new one
+	for i := 0; i < whitePeerlistLimit; i++ {
+		a := address(i)
+		p.whitePeers[a.String()] = PeerListEntry{Address: a, LastSeen: now + int64(i)}
+	}
+	oldest := address(0)
+	p.RecordFailure(oldest)
+	p.SetPeerHandshaked(address(len(peers)+len(fresh)), 1)
+	if _, present := p.whitePeers[oldest.String()]; present {
+		t.Fatal("the oldest white peer is not evicted")
+	}
+	if len(p.failures) != 0 {
+		t.Fatal("failures of the evicted white peer are kept")
+	}
+}
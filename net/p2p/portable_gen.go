@@ -0,0 +1,253 @@
+// Code generated by portable-gen. DO NOT EDIT.
+
+package p2p
+
+import "github.com/SMemsky/go-flakechain/storages/portable"
+
+func (m *HandshakeRequest) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(2)
+	w.Object("node_data", &m.NodeData)
+	w.Object("payload_data", &m.SyncData)
+	return w.Err()
+}
+
+var handshakeRequestEntries = []string{"node_data", "payload_data"}
+
+func (m *HandshakeRequest) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(handshakeRequestEntries) {
+		switch r.Index() {
+		case 0:
+			r.Object(&m.NodeData)
+		case 1:
+			r.Object(&m.SyncData)
+		}
+	}
+	return r.End(0, 1)
+}
+
+func (m *HandshakeResponse) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(4)
+	w.String("local_peerlist", m.Deprecated)
+	w.Objects("local_peerlist_new", len(m.Peers))
+	for i := range m.Peers {
+		w.ObjectElement(&m.Peers[i])
+	}
+	w.Object("node_data", &m.NodeData)
+	w.Object("payload_data", &m.SyncData)
+	return w.Err()
+}
+
+var handshakeResponseEntries = []string{"local_peerlist", "local_peerlist_new", "node_data", "payload_data"}
+
+func (m *HandshakeResponse) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(handshakeResponseEntries) {
+		switch r.Index() {
+		case 0:
+			m.Deprecated = r.String()
+		case 1:
+			m.Peers = make([]PeerListEntry, 0, r.Array())
+			for r.NextElement() {
+				m.Peers = append(m.Peers, PeerListEntry{})
+				r.Object(&m.Peers[len(m.Peers)-1])
+			}
+		case 2:
+			r.Object(&m.NodeData)
+		case 3:
+			r.Object(&m.SyncData)
+		}
+	}
+	return r.End(0, 1, 2, 3)
+}
+
+func (m *TimedSyncRequest) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(1)
+	w.Object("payload_data", &m.SyncData)
+	return w.Err()
+}
+
+var timedSyncRequestEntries = []string{"payload_data"}
+
+func (m *TimedSyncRequest) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(timedSyncRequestEntries) {
+		switch r.Index() {
+		case 0:
+			r.Object(&m.SyncData)
+		}
+	}
+	return r.End(0)
+}
+
+func (m *TimedSyncResponse) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(4)
+	w.Uint64("local_time", m.LocalTime)
+	w.Object("payload_data", &m.SyncData)
+	w.String("local_peerlist", m.Deprecated)
+	w.Objects("local_peerlist_new", len(m.Peers))
+	for i := range m.Peers {
+		w.ObjectElement(&m.Peers[i])
+	}
+	return w.Err()
+}
+
+var timedSyncResponseEntries = []string{"local_time", "payload_data", "local_peerlist", "local_peerlist_new"}
+
+func (m *TimedSyncResponse) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(timedSyncResponseEntries) {
+		switch r.Index() {
+		case 0:
+			m.LocalTime = r.Uint64()
+		case 1:
+			r.Object(&m.SyncData)
+		case 2:
+			m.Deprecated = r.String()
+		case 3:
+			m.Peers = make([]PeerListEntry, 0, r.Array())
+			for r.NextElement() {
+				m.Peers = append(m.Peers, PeerListEntry{})
+				r.Object(&m.Peers[len(m.Peers)-1])
+			}
+		}
+	}
+	return r.End(0, 1, 2, 3)
+}
+
+func (m *PingResponse) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(2)
+	w.String("status", m.Status)
+	w.Uint64("peer_id", m.PeerId)
+	return w.Err()
+}
+
+var pingResponseEntries = []string{"status", "peer_id"}
+
+func (m *PingResponse) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(pingResponseEntries) {
+		switch r.Index() {
+		case 0:
+			m.Status = r.String()
+		case 1:
+			m.PeerId = r.Uint64()
+		}
+	}
+	return r.End(0, 1)
+}
+
+func (m *SupportedFlagsResponse) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(1)
+	w.Uint32("support_flags", m.Flags)
+	return w.Err()
+}
+
+var supportedFlagsResponseEntries = []string{"support_flags"}
+
+func (m *SupportedFlagsResponse) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(supportedFlagsResponseEntries) {
+		switch r.Index() {
+		case 0:
+			m.Flags = r.Uint32()
+		}
+	}
+	return r.End(0)
+}
+
+func (m *BasicNodeData) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(4)
+	w.Uint64("local_time", m.LocalTime)
+	w.Uint32("my_port", m.MyPort)
+	w.String("network_id", m.NetworkId)
+	w.Uint64("peer_id", m.PeerId)
+	return w.Err()
+}
+
+var basicNodeDataEntries = []string{"local_time", "my_port", "network_id", "peer_id"}
+
+func (m *BasicNodeData) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(basicNodeDataEntries) {
+		switch r.Index() {
+		case 0:
+			m.LocalTime = r.Uint64()
+		case 1:
+			m.MyPort = r.Uint32()
+		case 2:
+			m.NetworkId = r.String()
+		case 3:
+			m.PeerId = r.Uint64()
+		}
+	}
+	return r.End(0, 1, 2, 3)
+}
+
+func (m *CoreSyncData) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(4)
+	w.Uint64("cumulative_difficulty", m.CumulativeDifficulty)
+	w.Uint64("current_height", m.CurrentHeight)
+	w.Bytes("top_id", m.TopId[:])
+	w.Uint8("top_version", m.TopVersion)
+	return w.Err()
+}
+
+var coreSyncDataEntries = []string{"cumulative_difficulty", "current_height", "top_id", "top_version"}
+
+func (m *CoreSyncData) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(coreSyncDataEntries) {
+		switch r.Index() {
+		case 0:
+			m.CumulativeDifficulty = r.Uint64()
+		case 1:
+			m.CurrentHeight = r.Uint64()
+		case 2:
+			r.ByteArray(m.TopId[:])
+		case 3:
+			m.TopVersion = r.Uint8()
+		}
+	}
+	return r.End(0, 1, 2, 3)
+}
+
+func (m *PeerListEntry) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(3)
+	w.Object("adr", &m.Address)
+	w.Uint64("id", m.Id)
+	w.Int64("last_seen", m.LastSeen)
+	return w.Err()
+}
+
+var peerListEntryEntries = []string{"adr", "id", "last_seen"}
+
+func (m *PeerListEntry) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(peerListEntryEntries) {
+		switch r.Index() {
+		case 0:
+			r.Object(&m.Address)
+		case 1:
+			m.Id = r.Uint64()
+		case 2:
+			m.LastSeen = r.Int64()
+		}
+	}
+	return r.End(0, 1, 2)
+}
+
+func (m *AnchorPeerListEntry) MarshalPortableObject(w *portable.ObjectWriter) error {
+	w.Begin(3)
+	w.Object("adr", &m.Address)
+	w.Uint64("id", m.Id)
+	w.Int64("first_seen", m.FirstSeen)
+	return w.Err()
+}
+
+var anchorPeerListEntryEntries = []string{"adr", "id", "first_seen"}
+
+func (m *AnchorPeerListEntry) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(anchorPeerListEntryEntries) {
+		switch r.Index() {
+		case 0:
+			r.Object(&m.Address)
+		case 1:
+			m.Id = r.Uint64()
+		case 2:
+			m.FirstSeen = r.Int64()
+		}
+	}
+	return r.End(0, 1, 2)
+}
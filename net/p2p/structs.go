@@ -1,10 +1,17 @@
 package p2p
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
+	"net/netip"
 	"strconv"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
 )
 
+var ErrBadAddress = errors.New("net/p2p: malformed or unsupported peer address")
+
 type BasicNodeData struct {
 	LocalTime uint64 `store:"local_time"`
 	MyPort    uint32 `store:"my_port"`
@@ -13,10 +20,10 @@ type BasicNodeData struct {
 }
 
 type CoreSyncData struct {
-	CumulativeDifficulty uint64 `store:"cumulative_difficulty"`
-	CurrentHeight        uint64 `store:"current_height"`
-	TopId                string `store:"top_id"`
-	TopVersion           uint8  `store:"top_version"`
+	CumulativeDifficulty uint64   `store:"cumulative_difficulty"`
+	CurrentHeight        uint64   `store:"current_height"`
+	TopId                [32]byte `store:"top_id"`
+	TopVersion           uint8    `store:"top_version"`
 }
 
 type PeerListEntry struct {
@@ -31,22 +38,191 @@ type AnchorPeerListEntry struct {
 	FirstSeen int64       `store:"first_seen"`
 }
 
-// Currently Type is always 1. We should add support for IPv6 someday..
+// Address types as numbered by the reference node
+const (
+	addressTypeIPv4 = 1
+	addressTypeIPv6 = 2
+	addressTypeI2P  = 3
+	addressTypeTor  = 4
+)
+
+// AddressType is a network address of a peer. IPv4 and IPv6 addresses are
+// kept in AddrPort. Tor addresses have no IP, so their host and port are kept
+// in OnionHost and OnionPort instead
 type AddressType struct {
-	Address struct {
-		Ip   uint32 `store:"m_ip"`
-		Port uint16 `store:"m_port"`
-	} `store:"addr"`
-	Type uint8 `store:"type"` // TODO: IPv6 support
+	AddrPort  netip.AddrPort
+	OnionHost string
+	OnionPort uint16
+}
+
+func NewAddress(addrPort netip.AddrPort) AddressType {
+	return AddressType{AddrPort: netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())}
+}
+
+func (a *AddressType) IsOnion() bool {
+	return a.OnionHost != ""
 }
 
 func (a *AddressType) String() string {
-	data := a.Address.Ip
-	ip4 := net.IPv4(byte(data>>24), byte(data>>16), byte(data>>8), byte(data))
-	return ip4.String() + ":" + strconv.Itoa(int(a.Address.Port))
+	if a.IsOnion() {
+		return net.JoinHostPort(a.OnionHost, strconv.Itoa(int(a.OnionPort)))
+	}
+	return a.AddrPort.String()
 }
 
+// IpString returns the host part of the address. For Tor peers that is the
+// onion host
 func (a *AddressType) IpString() string {
-	data := a.Address.Ip
-	return net.IPv4(byte(data>>24), byte(data>>16), byte(data>>8), byte(data)).String()
+	if a.IsOnion() {
+		return a.OnionHost
+	}
+	return a.AddrPort.Addr().String()
+}
+
+// MarshalPortable returns the address as a section, see
+// MarshalPortableObject for its layout. Both directions go through the
+// object codec, so the two can't disagree
+func (a *AddressType) MarshalPortable() (portable.Value, error) {
+	data, err := portable.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	return portable.UnmarshalSection(data)
+}
+
+func (a *AddressType) UnmarshalPortable(v portable.Value) error {
+	s, ok := v.(*portable.Section)
+	if !ok {
+		return ErrBadAddress
+	}
+	data, err := portable.MarshalSection(s)
+	if err != nil {
+		return err
+	}
+	return portable.Unmarshal(data, a)
+}
+
+// Entries of the address object and of its addr object
+var (
+	addressEntries     = []string{"addr", "type"}
+	addressAddrEntries = []string{"m_ip", "m_port", "addr", "host", "port"}
+)
+
+// MarshalPortableObject writes the address in the layout of the reference
+// node:
+//
+//	{addr: {m_ip: uint32, m_port: uint16}, type: 1}
+//	{addr: {addr: 16 byte string, m_port: uint16}, type: 2}
+//	{addr: {host: string, port: uint16}, type: 4}
+//
+// IPv4 m_ip holds the address in network byte order, so its little endian
+// bytes are the octets
+func (a *AddressType) MarshalPortableObject(w *portable.ObjectWriter) error {
+	ip := a.AddrPort.Addr()
+	var addressType uint8
+	switch {
+	case a.IsOnion():
+		addressType = addressTypeTor
+	case ip.Is4():
+		addressType = addressTypeIPv4
+	case ip.Is6():
+		addressType = addressTypeIPv6
+	default:
+		return ErrBadAddress
+	}
+	w.Begin(2)
+	w.Object("addr", (*addressAddr)(a))
+	w.Uint8("type", addressType)
+	return w.Err()
+}
+
+// The addr object of an address
+type addressAddr AddressType
+
+func (addr *addressAddr) MarshalPortableObject(w *portable.ObjectWriter) error {
+	a := (*AddressType)(addr)
+	w.Begin(2)
+	if a.IsOnion() {
+		w.String("host", a.OnionHost)
+		w.Uint16("port", a.OnionPort)
+		return w.Err()
+	}
+	if ip := a.AddrPort.Addr(); ip.Is4() {
+		octets := ip.As4()
+		w.Uint32("m_ip", binary.LittleEndian.Uint32(octets[:]))
+	} else {
+		octets := ip.As16()
+		w.Bytes("addr", octets[:])
+	}
+	w.Uint16("m_port", a.AddrPort.Port())
+	return w.Err()
+}
+
+func (a *AddressType) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	addr := &addressFields{}
+	var addressType uint8
+	for r.Next(addressEntries) {
+		switch r.Index() {
+		case 0:
+			r.Object(addr)
+		case 1:
+			addressType = r.Uint8()
+		}
+	}
+	if err := r.End(); err != nil {
+		return err
+	}
+
+	*a = AddressType{}
+	p := &addr.present
+	switch addressType {
+	case addressTypeIPv4:
+		if !p[0] || !p[1] {
+			return ErrBadAddress
+		}
+		var octets [4]byte
+		binary.LittleEndian.PutUint32(octets[:], addr.ip)
+		a.AddrPort = netip.AddrPortFrom(netip.AddrFrom4(octets), addr.port)
+	case addressTypeIPv6:
+		if !p[2] || !p[1] {
+			return ErrBadAddress
+		}
+		a.AddrPort = netip.AddrPortFrom(netip.AddrFrom16(addr.ipv6), addr.port)
+	case addressTypeTor:
+		if !p[3] || !p[4] || addr.host == "" {
+			return ErrBadAddress
+		}
+		a.OnionHost = addr.host
+		a.OnionPort = addr.port
+	default:
+		return ErrBadAddress
+	}
+	return nil
+}
+
+// Entries of the addr object of any address type, they are sorted out once
+// the type is known
+type addressFields struct {
+	ip      uint32
+	ipv6    [16]byte
+	host    string
+	port    uint16
+	present [5]bool // by index in addressAddrEntries
+}
+
+func (f *addressFields) UnmarshalPortableObject(r *portable.ObjectReader) error {
+	for r.Next(addressAddrEntries) {
+		f.present[r.Index()] = true
+		switch r.Index() {
+		case 0:
+			f.ip = r.Uint32()
+		case 1, 4:
+			f.port = r.Uint16()
+		case 2:
+			r.ByteArray(f.ipv6[:])
+		case 3:
+			f.host = r.String()
+		}
+	}
+	return r.End()
 }
@@ -0,0 +1,158 @@
+package p2p
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/SMemsky/go-flakechain/storages/portable"
+)
+
+func TestAddressWireFormat(t *testing.T) {
+	entry := PeerListEntry{
+		Address: NewAddress(netip.MustParseAddrPort("188.35.187.49:12560")),
+		Id:      1,
+	}
+	data, err := portable.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Must match the layout the address had as a plain struct
+	legacy := struct {
+		Address struct {
+			Address struct {
+				Ip   uint32 `store:"m_ip"`
+				Port uint16 `store:"m_port"`
+			} `store:"addr"`
+			Type uint8 `store:"type"`
+		} `store:"adr"`
+		Id       uint64 `store:"id"`
+		LastSeen int64  `store:"last_seen"`
+	}{}
+	if err := portable.Unmarshal(data, &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Address.Address.Ip != 0x31bb23bc || legacy.Address.Address.Port != 12560 || legacy.Address.Type != 1 {
+		t.Errorf("unexpected legacy address: %+v", legacy.Address)
+	}
+	legacyData, err := portable.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, legacyData) {
+		t.Errorf("encoding differs from legacy:\n%x\n%x", data, legacyData)
+	}
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	for _, a := range []AddressType{
+		NewAddress(netip.MustParseAddrPort("1.2.3.4:18080")),
+		NewAddress(netip.MustParseAddrPort("[2001:db8::1]:18080")),
+		{OnionHost: "zpv4fa3szgel7vf6jdjeugizdclq2vzkelscs2bhbgnlldzzggcen3ad.onion", OnionPort: 18083},
+	} {
+		entry := AnchorPeerListEntry{Address: a, Id: 7, FirstSeen: 100}
+		data, err := portable.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := AnchorPeerListEntry{}
+		if err := portable.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != entry {
+			t.Errorf("round trip mismatch: %s != %s", out.Address.String(), a.String())
+		}
+
+		// Direct encoding has the layout of the dynamic one
+		v, err := a.MarshalPortable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dynamic, _ := portable.MarshalSection(v.(*portable.Section))
+		if direct, err := portable.Marshal(&a); err != nil || !bytes.Equal(direct, dynamic) {
+			t.Errorf("direct encoding of %s differs:\n%x\n%x", a.String(), direct, dynamic)
+		}
+
+		// Binary IPv6 address goes to JSON as a binary string
+		data, err = portable.ToJSON(entry)
+		if err != nil {
+			t.Fatal(a.String(), err)
+		}
+		out = AnchorPeerListEntry{}
+		if err := portable.FromJSON(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != entry {
+			t.Errorf("JSON round trip mismatch: %s != %s", out.Address.String(), a.String())
+		}
+	}
+
+	if a := NewAddress(netip.MustParseAddrPort("[::ffff:1.2.3.4]:1")); a.String() != "1.2.3.4:1" {
+		t.Errorf("mapped address is not unmapped: %s", a.String())
+	}
+}
+
+func TestAddressCodecs(t *testing.T) {
+	address := func(addressType uint8, entries map[string]portable.Value) *portable.Section {
+		addr := portable.NewSection()
+		for _, name := range []string{"m_ip", "addr", "host", "m_port", "port"} {
+			if v, ok := entries[name]; ok {
+				addr.Set(name, v)
+			}
+		}
+		s := portable.NewSection()
+		s.Set("addr", addr)
+		s.Set("type", addressType)
+		return s
+	}
+	ipv6 := netip.MustParseAddr("2001:db8::1").As16()
+	onion := "zpv4fa3szgel7vf6jdjeugizdclq2vzkelscs2bhbgnlldzzggcen3ad.onion"
+
+	tests := map[string]*portable.Section{
+		"ipv4":          address(1, map[string]portable.Value{"m_ip": uint32(0x04030201), "m_port": uint16(18080)}),
+		"ipv4 wide":     address(1, map[string]portable.Value{"m_ip": uint64(0x04030201), "m_port": uint64(18080)}),
+		"ipv6":          address(2, map[string]portable.Value{"addr": string(ipv6[:]), "m_port": uint16(18080)}),
+		"ipv6 blob":     address(2, map[string]portable.Value{"addr": portable.Blob(ipv6[:]), "m_port": uint16(18080)}),
+		"tor":           address(4, map[string]portable.Value{"host": onion, "port": uint16(18083)}),
+		"ipv6 hex":      address(2, map[string]portable.Value{"addr": "20010db8000000000000000000000001", "m_port": uint16(1)}),
+		"ipv6 short":    address(2, map[string]portable.Value{"addr": "\x20\x01", "m_port": uint16(1)}),
+		"missing port":  address(1, map[string]portable.Value{"m_ip": uint32(1)}),
+		"port overflow": address(1, map[string]portable.Value{"m_ip": uint32(1), "m_port": uint32(1 << 16)}),
+		"empty host":    address(4, map[string]portable.Value{"host": "", "port": uint16(1)}),
+		"i2p":           address(3, map[string]portable.Value{"host": onion, "port": uint16(1)}),
+		"string ip":     address(1, map[string]portable.Value{"m_ip": "1.2.3.4", "m_port": uint16(1)}),
+	}
+	valid := map[string]string{
+		"ipv4":      "1.2.3.4:18080",
+		"ipv4 wide": "1.2.3.4:18080",
+		"ipv6":      "[2001:db8::1]:18080",
+		"ipv6 blob": "[2001:db8::1]:18080",
+		"tor":       onion + ":18083",
+	}
+
+	for name, s := range tests {
+		fromSection := AddressType{}
+		sectionErr := fromSection.UnmarshalPortable(s)
+
+		data, err := portable.MarshalSection(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromObject := AddressType{}
+		objectErr := portable.Unmarshal(data, &fromObject)
+
+		if fromSection != fromObject || !reflect.DeepEqual(sectionErr, objectErr) {
+			t.Errorf("%s: paths disagree: %s, %v and %s, %v", name,
+				fromSection.String(), sectionErr, fromObject.String(), objectErr)
+		}
+		if want, ok := valid[name]; ok {
+			if objectErr != nil || fromObject.String() != want {
+				t.Errorf("%s: decoded %s, %v, want %s", name, fromObject.String(), objectErr, want)
+			}
+		} else if objectErr == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
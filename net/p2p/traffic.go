@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SMemsky/go-flakechain/net/levin"
+)
+
+// Aggregates traffic counters of all node connections, including the closed
+// ones. Implements levin.Observer
+type traffic struct {
+	mutex sync.Mutex
+	stats levin.Stats
+}
+
+func newTraffic() *traffic {
+	return &traffic{
+		stats: levin.Stats{
+			Commands:  make(map[uint32]levin.CommandStats),
+			Connected: time.Now(),
+		},
+	}
+}
+
+func (t *traffic) PacketSent(c levin.Conn, commandId uint32, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cs := t.stats.Commands[commandId]
+	cs.BytesOut += uint64(size)
+	cs.PacketsOut++
+	t.stats.Commands[commandId] = cs
+	t.stats.Total.BytesOut += uint64(size)
+	t.stats.Total.PacketsOut++
+	t.stats.LastActivity = time.Now()
+}
+
+func (t *traffic) PacketReceived(c levin.Conn, commandId uint32, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cs := t.stats.Commands[commandId]
+	cs.BytesIn += uint64(size)
+	cs.PacketsIn++
+	t.stats.Commands[commandId] = cs
+	t.stats.Total.BytesIn += uint64(size)
+	t.stats.Total.PacketsIn++
+	t.stats.LastActivity = time.Now()
+}
+
+func (t *traffic) InvokeDone(c levin.Conn, commandId uint32, latency time.Duration, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err == levin.ErrTimedOut {
+		t.stats.Timeouts++
+	} else if err == nil {
+		t.stats.Invokes++
+		t.stats.InvokeTime += latency
+		if latency > t.stats.MaxInvokeTime {
+			t.stats.MaxInvokeTime = latency
+		}
+	}
+}
+
+func (t *traffic) snapshot() levin.Stats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	s := t.stats
+	s.Commands = make(map[uint32]levin.CommandStats, len(t.stats.Commands))
+	for k, v := range t.stats.Commands {
+		s.Commands[k] = v
+	}
+	return s
+}
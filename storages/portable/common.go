@@ -20,14 +20,14 @@ const (
 	serializeTypeString  = 10
 	serializeTypeBool    = 11
 	serializeTypeObject  = 12
-	serializeTypeArray   = 13 // TODO
+	serializeTypeArray   = 13 // Only used for arrays of arrays
 
 	serializeArrayMask = 0x80
 
 	portableVarint8  = 0
 	portableVarint16 = 1
 	portableVarint32 = 2
-	portableVarint64 = 4
+	portableVarint64 = 3
 )
 
 var (
@@ -41,11 +41,18 @@ var (
 	ErrEntryCount   = errors.New("storages/portable: some entries are missing")
 	ErrEntryMissing = errors.New("storages/portable: entry is missing or duplicated")
 	ErrTypeMismatch = errors.New("storages/portable: type mismatch")
+	ErrOverflow     = errors.New("storages/portable: integer does not fit")
 
 	ErrUnknownType = errors.New("storages/portable: unknown serialize type")
 
 	ErrBadArray = errors.New("storages/portable: unknown slice type")
+	ErrBadBlob  = errors.New("storages/portable: blob size mismatch")
 	ErrBadKind  = errors.New("storages/portable: array kind mismatch")
+
+	ErrTooBig  = errors.New("storages/portable: storage exceeds the byte budget")
+	ErrTooDeep = errors.New("storages/portable: nesting is too deep")
+	ErrTooMany = errors.New("storages/portable: too many elements")
+	ErrTooLong = errors.New("storages/portable: string is too long")
 )
 
 var (
@@ -63,6 +70,7 @@ var (
 		serializeTypeString:  reflect.String,
 		serializeTypeBool:    reflect.Bool,
 		serializeTypeObject:  reflect.Struct,
+		serializeTypeArray:   reflect.Slice,
 	}
 )
 
@@ -0,0 +1,162 @@
+package portable
+
+// Conversions of dynamic values for hand-written Unmarshaler implementations.
+// Section.Int and Section.Uint are built on ToInt and ToUint, and
+// ObjectReader shares their range checks. They follow the rules of the
+// reflective decoder: integers of any width and signedness are
+// interchangeable as long as the value fits into bits
+
+// ToUint converts an integer entry into an unsigned integer of the given size
+func ToUint(v Value, bits int) (uint64, error) {
+	magnitude, negative, ok := integer(v)
+	if !ok {
+		return 0, ErrTypeMismatch
+	}
+	return toUint(magnitude, negative, bits)
+}
+
+// ToInt converts an integer entry into a signed integer of the given size
+func ToInt(v Value, bits int) (int64, error) {
+	magnitude, negative, ok := integer(v)
+	if !ok {
+		return 0, ErrTypeMismatch
+	}
+	return toInt(magnitude, negative, bits)
+}
+
+// ToBlob returns a binary string entry of the given size. Such entries are
+// strings when decoded from the storage and Blob when decoded from JSON
+func ToBlob(v Value, size int) ([]byte, error) {
+	switch value := v.(type) {
+	case Blob:
+		if len(value) == size {
+			return value, nil
+		}
+	case string:
+		if len(value) == size {
+			return []byte(value), nil
+		}
+	default:
+		return nil, ErrTypeMismatch
+	}
+	return nil, ErrBadBlob
+}
+
+// ToUints converts an array of integers of any type, see ToUint
+func ToUints(v Value, bits int) ([]uint64, error) {
+	var result []uint64
+	err := eachInteger(v, func(magnitude uint64, negative bool) error {
+		value, err := toUint(magnitude, negative, bits)
+		result = append(result, value)
+		return err
+	})
+	return result, err
+}
+
+// ToInts converts an array of integers of any type, see ToInt
+func ToInts(v Value, bits int) ([]int64, error) {
+	var result []int64
+	err := eachInteger(v, func(magnitude uint64, negative bool) error {
+		value, err := toInt(magnitude, negative, bits)
+		result = append(result, value)
+		return err
+	})
+	return result, err
+}
+
+func toUint(magnitude uint64, negative bool, bits int) (uint64, error) {
+	if (negative && magnitude != 0) || (bits < 64 && magnitude >= 1<<bits) {
+		return 0, ErrOverflow
+	}
+	return magnitude, nil
+}
+
+func toInt(magnitude uint64, negative bool, bits int) (int64, error) {
+	limit := uint64(1) << (bits - 1)
+	if negative {
+		if magnitude > limit {
+			return 0, ErrOverflow
+		}
+		return -int64(magnitude), nil
+	}
+	if magnitude >= limit {
+		return 0, ErrOverflow
+	}
+	return int64(magnitude), nil
+}
+
+// Splits an integer of any type into its magnitude and sign
+func integer(v Value) (uint64, bool, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return n, false, true
+	case uint32:
+		return uint64(n), false, true
+	case uint16:
+		return uint64(n), false, true
+	case uint8:
+		return uint64(n), false, true
+	case int64:
+		return signed(n)
+	case int32:
+		return signed(int64(n))
+	case int16:
+		return signed(int64(n))
+	case int8:
+		return signed(int64(n))
+	}
+	return 0, false, false
+}
+
+func signed(n int64) (uint64, bool, bool) {
+	if n < 0 {
+		return uint64(-n), true, true
+	}
+	return uint64(n), false, true
+}
+
+// Calls f for every element of an integer array, see integer
+func eachInteger(v Value, f func(magnitude uint64, negative bool) error) error {
+	var err error
+	switch s := v.(type) {
+	case []uint64:
+		for i := 0; i < len(s) && err == nil; i++ {
+			err = f(s[i], false)
+		}
+	case []uint32:
+		for i := 0; i < len(s) && err == nil; i++ {
+			err = f(uint64(s[i]), false)
+		}
+	case []uint16:
+		for i := 0; i < len(s) && err == nil; i++ {
+			err = f(uint64(s[i]), false)
+		}
+	case []uint8:
+		for i := 0; i < len(s) && err == nil; i++ {
+			err = f(uint64(s[i]), false)
+		}
+	case []int64:
+		for i := 0; i < len(s) && err == nil; i++ {
+			magnitude, negative, _ := signed(s[i])
+			err = f(magnitude, negative)
+		}
+	case []int32:
+		for i := 0; i < len(s) && err == nil; i++ {
+			magnitude, negative, _ := signed(int64(s[i]))
+			err = f(magnitude, negative)
+		}
+	case []int16:
+		for i := 0; i < len(s) && err == nil; i++ {
+			magnitude, negative, _ := signed(int64(s[i]))
+			err = f(magnitude, negative)
+		}
+	case []int8:
+		for i := 0; i < len(s) && err == nil; i++ {
+			magnitude, negative, _ := signed(int64(s[i]))
+			err = f(magnitude, negative)
+		}
+	default:
+		return ErrTypeMismatch
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package portable
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Describes a struct field stored in portable storage. Fields are tagged as
+// `store:"name"` optionally followed by comma separated options:
+//
+//	optional  - entry may be missing when decoding, field keeps zero value
+//	omitempty - entry is not written if the field has zero value. Implies
+//	            optional
+//	blob      - a fixed-size value or a slice of those (e.g. []uint64 or
+//	            [][32]byte) is packed into a single string, like epee does
+//	            with POD containers. Only affects binary encoding
+type field struct {
+	index     int
+	name      string
+	optional  bool
+	omitEmpty bool
+	blob      bool
+}
+
+// Byte slices and byte arrays are stored as strings
+func isBytes(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && t.Elem().Kind() == reflect.Uint8
+}
+
+// Tells whether values of type t are stored as portable arrays
+func isArray(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && !isBytes(t)
+}
+
+// Stored fields of a struct type and their positions by name
+type structInfo struct {
+	fields []field
+	byName map[string]int
+}
+
+// Tags are parsed once per type, reflect.Type -> *structInfo
+var structCache sync.Map
+
+func cachedStruct(t reflect.Type) *structInfo {
+	if info, ok := structCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	fields := parseFields(t)
+	info := &structInfo{fields, make(map[string]int, len(fields))}
+	for i, f := range fields {
+		info.byName[f.name] = i
+	}
+	actual, _ := structCache.LoadOrStore(t, info)
+	return actual.(*structInfo)
+}
+
+// Returns stored fields of struct type t in declaration order. The slice is
+// shared and must not be modified
+func structFields(t reflect.Type) []field {
+	return cachedStruct(t).fields
+}
+
+func parseFields(t reflect.Type) []field {
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("store")
+		if !ok {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		f := field{index: i, name: parts[0]}
+		for _, option := range parts[1:] {
+			switch option {
+			case "optional":
+				f.optional = true
+			case "omitempty":
+				f.optional = true
+				f.omitEmpty = true
+			case "blob":
+				f.blob = true
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// Tells whether t is a struct with stored fields. Such structs are mapped to
+// JSON the same way whether their portable methods are generated or not
+func isTagged(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && len(structFields(t)) != 0
+}
@@ -0,0 +1,183 @@
+package portable
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Mirrors the handshake layout, so the seeds get past the root
+type fuzzHandshake struct {
+	NodeData struct {
+		LocalTime uint64 `store:"local_time"`
+		MyPort    uint32 `store:"my_port"`
+		NetworkId string `store:"network_id"`
+		PeerId    uint64 `store:"peer_id"`
+	} `store:"node_data"`
+	SyncData struct {
+		CumulativeDifficulty uint64   `store:"cumulative_difficulty"`
+		CurrentHeight        uint64   `store:"current_height"`
+		TopId                [32]byte `store:"top_id"`
+		TopVersion           uint8    `store:"top_version"`
+	} `store:"payload_data"`
+	Peers []struct {
+		Address struct {
+			Address struct {
+				Ip   uint32 `store:"m_ip"`
+				Port uint16 `store:"m_port"`
+			} `store:"addr"`
+			Type uint8 `store:"type"`
+		} `store:"adr"`
+		Id       uint64 `store:"id"`
+		LastSeen int64  `store:"last_seen"`
+	} `store:"local_peerlist_new,optional"`
+}
+
+// Seeds are real handshake packets, see testdata/fuzz/FuzzUnmarshal
+func FuzzUnmarshal(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Unmarshal(data, &fuzzHandshake{})
+
+		s, err := UnmarshalSection(data)
+		if err != nil {
+			return
+		}
+		encoded, err := MarshalSection(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := UnmarshalSection(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reencoded, err := MarshalSection(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, reencoded) {
+			t.Errorf("unstable encoding:\n%x\n%x", encoded, reencoded)
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	in := testAllValue()
+	data, _ := Marshal(&in)
+
+	for _, test := range []struct {
+		limits Limits
+		err    error
+	}{
+		{Limits{MaxDepth: 3}, ErrTooDeep},
+		{Limits{MaxElements: 10}, ErrTooMany},
+		{Limits{MaxStringLength: 10}, ErrTooLong},
+		{Limits{MaxBytes: 100}, ErrTooBig},
+		{Limits{}, nil},
+		{DefaultLimits, nil},
+	} {
+		d := NewDecoder(bytes.NewReader(data))
+		d.SetLimits(test.limits)
+		if err := d.Decode(&testAll{}); err != test.err {
+			t.Errorf("%+v: err = %v, want %v", test.limits, err, test.err)
+		}
+		// Skipped entries are limited the same way
+		d = NewDecoder(bytes.NewReader(data))
+		d.SetLimits(test.limits)
+		if err := d.Decode(&struct{}{}); err != test.err {
+			t.Errorf("%+v: skipping err = %v, want %v", test.limits, err, test.err)
+		}
+	}
+}
+
+// Large but legitimate messages, such as a long chain of block ids along with
+// a full peerlist, pass the default limits
+func TestLimitsLargePacket(t *testing.T) {
+	type peer struct {
+		Ip       uint32 `store:"m_ip"`
+		Port     uint16 `store:"m_port"`
+		Id       uint64 `store:"id"`
+		LastSeen int64  `store:"last_seen"`
+	}
+	type packet struct {
+		Ids    []uint64 `store:"ids"`
+		Hashes []string `store:"hashes"`
+		Blocks []byte   `store:"blocks"`
+		Peers  []peer   `store:"peers"`
+	}
+
+	in := packet{
+		Ids:    make([]uint64, 1<<20),
+		Hashes: make([]string, 1<<19),
+		Blocks: make([]byte, 16<<20),
+		Peers:  make([]peer, 5000),
+	}
+	for i := range in.Ids {
+		in.Ids[i] = uint64(i)
+	}
+	for i := range in.Hashes {
+		in.Hashes[i] = "hash"
+	}
+	for i := range in.Peers {
+		in.Peers[i] = peer{uint32(i), 18080, uint64(i), int64(i)}
+	}
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := packet{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Error("large packet changed")
+	}
+	if _, err := UnmarshalSection(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(data, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostileCounts(t *testing.T) {
+	header := []byte{0x01, 0x11, 0x01, 0x01, 0x01, 0x01, 0x02, 0x01, 0x01}
+	// One entry "a", an array of uint64 claiming 2^30-1 elements, which
+	// can't fit into the byte budget
+	huge := append(append([]byte{}, header...), 0x04, 0x01, 'a', serializeTypeUint64|serializeArrayMask, 0xfe, 0xff, 0xff, 0xff)
+	if err := Unmarshal(huge, &struct {
+		A []uint64 `store:"a"`
+	}{}); err != ErrTooBig {
+		t.Errorf("err = %v, want %v", err, ErrTooBig)
+	}
+
+	// The same count of objects
+	objects := append(append([]byte{}, header...), 0x04, 0x01, 'a', serializeTypeObject|serializeArrayMask, 0xfe, 0xff, 0xff, 0xff)
+	if _, err := UnmarshalSection(objects); err != ErrTooMany {
+		t.Errorf("err = %v, want %v", err, ErrTooMany)
+	}
+	if err := Unmarshal(objects, &struct{}{}); err != ErrTooMany {
+		t.Errorf("skipping err = %v, want %v", err, ErrTooMany)
+	}
+
+	// A string claiming 2^30-1 bytes
+	long := append(append([]byte{}, header...), 0x04, 0x01, 'a', serializeTypeString, 0xfe, 0xff, 0xff, 0xff)
+	if err := Unmarshal(long, &struct {
+		A string `store:"a"`
+	}{}); err != ErrTooLong {
+		t.Errorf("err = %v, want %v", err, ErrTooLong)
+	}
+
+	// Objects nested way too deep
+	deep := append([]byte{}, header...)
+	for i := 0; i < 10000; i++ {
+		deep = append(deep, 0x04, 0x01, 'a', serializeTypeObject)
+	}
+	deep = append(deep, 0x00)
+	if _, err := UnmarshalSection(deep); err != ErrTooDeep {
+		t.Errorf("err = %v, want %v", err, ErrTooDeep)
+	}
+	if err := Unmarshal(deep, &struct{}{}); err != ErrTooDeep {
+		t.Errorf("skipping err = %v, want %v", err, ErrTooDeep)
+	}
+}
@@ -0,0 +1,575 @@
+package portable
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSON mapping
+//
+// Sections and tagged structs are JSON objects, entries keep their order.
+// Integers of every width are JSON numbers written and read with full 64-bit
+// precision, they never pass through float64. Floats are JSON numbers too,
+// NaN and infinities are rejected. Strings are JSON strings when they are
+// valid UTF-8. Binary strings, such as hashes in a decoded handshake, and
+// Blob values are objects with a single "$blob" entry holding lowercase hex:
+//
+//	{"top_id":{"$blob":"418015bb9ae982a1975da7d79277c2705727a56894ba0fb246adaabb1f4632e3"}}
+//
+// A section which looks exactly like that can't be told from a binary string
+// and is rejected. []byte and [N]byte fields are plain hex strings, since
+// their type is known. Arrays, nested ones included, are JSON arrays.
+// The blob tag option does not affect JSON, so blob packed []uint64 is still
+// an array of numbers. Other types implementing Marshaler and Unmarshaler
+// are converted through their dynamic values. Tagged structs always keep the
+// mapping above, so generated portable methods don't change their JSON.
+//
+// Decoding into a struct takes the types from the struct. Decoding into a
+// *Section infers them: whole numbers become uint64 (int64 if negative),
+// other numbers become float64, binary strings become Blob, arrays become
+// typed slices of the widest element type and empty arrays become empty
+// []Value. Integer widths are not kept, so such a section is encoded with
+// 8-byte integers where the original might have used smaller ones. Decoding
+// it into a struct still gives the same values, as integers of any width are
+// interchangeable there
+
+// Name of the entry marking a binary string
+const jsonBlob = "$blob"
+
+var (
+	ErrJSONString = errors.New("storages/portable: string is not valid UTF-8")
+	ErrJSONNumber = errors.New("storages/portable: number can't be represented in JSON")
+	ErrJSONSyntax = errors.New("storages/portable: unexpected JSON token")
+	ErrJSONBlob   = errors.New("storages/portable: section looks like a binary string in JSON")
+)
+
+// ToJSON encodes v, which is either a tagged struct (or a pointer to one) or
+// a *Section, as JSON
+func ToJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if s, ok := v.(*Section); ok {
+		if err := sectionToJSON(&b, s); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	rv := addressable(reflect.Indirect(reflect.ValueOf(v)))
+	if m, ok := asMarshaler(rv); ok && !isTagged(rv.Type()) {
+		value, err := m.MarshalPortable()
+		if err != nil {
+			return nil, err
+		}
+		s, ok := value.(*Section)
+		if !ok {
+			return nil, ErrBadRoot
+		}
+		if err := sectionToJSON(&b, s); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, ErrBadRoot
+	}
+	if err := valueToJSON(&b, rv); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// FromJSON decodes JSON into v, which is either a pointer to a tagged struct
+// or a *Section
+func FromJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	parsed, err := parseJSON(d)
+	if err != nil {
+		return err
+	}
+	root, ok := parsed.(*Section)
+	if !ok {
+		return ErrBadRoot
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return ErrJSONSyntax
+	}
+
+	if s, ok := v.(*Section); ok {
+		*s = *root
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return ErrBadRoot
+	}
+	if u, ok := asUnmarshaler(rv.Elem()); ok && !isTagged(rv.Elem().Type()) {
+		return u.UnmarshalPortable(root)
+	}
+	if rv.Elem().Kind() != reflect.Struct {
+		return ErrBadRoot
+	}
+	return assignJSON(rv.Elem(), root)
+}
+
+func sectionToJSON(b *bytes.Buffer, s *Section) error {
+	if isJSONBlob(s) {
+		return ErrJSONBlob
+	}
+	b.WriteByte('{')
+	for i, e := range s.entries {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		if err := stringToJSON(b, e.name); err != nil {
+			return err
+		}
+		b.WriteByte(':')
+		if err := dynamicToJSON(b, e.value); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func dynamicToJSON(b *bytes.Buffer, v Value) error {
+	switch value := v.(type) {
+	case *Section:
+		return sectionToJSON(b, value)
+	case []*Section:
+		b.WriteByte('[')
+		for i, s := range value {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			if err := sectionToJSON(b, s); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+	case []uint8:
+		// Would be a hex string if passed to valueToJSON
+		b.WriteByte('[')
+		for i, n := range value {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.FormatUint(uint64(n), 10))
+		}
+		b.WriteByte(']')
+		return nil
+	case Blob:
+		blobToJSON(b, value)
+		return nil
+	case []Value:
+		b.WriteByte('[')
+		for i, nested := range value {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			if err := dynamicToJSON(b, nested); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+	case int64, int32, int16, int8, uint64, uint32, uint16, uint8, float64, string, bool,
+		[]int64, []int32, []int16, []int8, []uint64, []uint32, []uint16, []float64, []string, []bool:
+		return valueToJSON(b, reflect.ValueOf(value))
+	}
+
+	return ErrUnknownType
+}
+
+func valueToJSON(b *bytes.Buffer, v reflect.Value) error {
+	if m, ok := asMarshaler(v); ok && !isTagged(v.Type()) {
+		value, err := m.MarshalPortable()
+		if err != nil {
+			return err
+		}
+		return dynamicToJSON(b, value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		b.WriteByte('{')
+		first := true
+		for _, f := range structFields(v.Type()) {
+			if f.omitEmpty && v.Field(f.index).IsZero() {
+				continue
+			}
+			if !first {
+				b.WriteByte(',')
+			}
+			first = false
+			if err := stringToJSON(b, f.name); err != nil {
+				return err
+			}
+			b.WriteByte(':')
+			if err := valueToJSON(b, v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			blobToJSON(b, []byte(v.String()))
+			return nil
+		}
+		return stringToJSON(b, v.String())
+	case reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
+		b.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		b.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return ErrJSONNumber
+		}
+		b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	case reflect.Bool:
+		b.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Slice, reflect.Array:
+		if isBytes(v.Type()) {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			return stringToJSON(b, hex.EncodeToString(data))
+		}
+		if v.Kind() == reflect.Array {
+			return ErrUnknownType
+		}
+		b.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			if err := valueToJSON(b, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		return ErrUnknownType
+	}
+	return nil
+}
+
+func stringToJSON(b *bytes.Buffer, s string) error {
+	if !utf8.ValidString(s) {
+		return ErrJSONString
+	}
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	b.Write(encoded)
+	return nil
+}
+
+func blobToJSON(b *bytes.Buffer, data []byte) {
+	b.WriteString(`{"` + jsonBlob + `":"`)
+	b.WriteString(hex.EncodeToString(data))
+	b.WriteString(`"}`)
+}
+
+// Reports whether s has the form of a binary string in JSON
+func isJSONBlob(s *Section) bool {
+	if len(s.entries) != 1 || s.entries[0].name != jsonBlob {
+		return false
+	}
+	switch s.entries[0].value.(type) {
+	case string, Blob:
+		return true
+	}
+	return false
+}
+
+// Parses the next JSON value into a dynamic value, inferring its type
+func parseJSON(d *json.Decoder) (Value, error) {
+	token, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			s := NewSection()
+			for d.More() {
+				key, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				name, ok := key.(string)
+				if !ok {
+					return nil, ErrJSONSyntax
+				}
+				v, err := parseJSON(d)
+				if err != nil {
+					return nil, err
+				}
+				s.Set(name, v)
+			}
+			if _, err := d.Token(); err != nil {
+				return nil, err
+			}
+			if isJSONBlob(s) {
+				encoded, _ := s.String(jsonBlob)
+				data, err := hex.DecodeString(encoded)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", ErrJSONSyntax, err)
+				}
+				return Blob(data), nil
+			}
+			return s, nil
+		case '[':
+			var values []Value
+			for d.More() {
+				v, err := parseJSON(d)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+			if _, err := d.Token(); err != nil {
+				return nil, err
+			}
+			return inferArray(values)
+		}
+	case json.Number:
+		if u, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return u, nil
+		}
+		if i, err := strconv.ParseInt(t.String(), 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrJSONNumber, t)
+		}
+		return f, nil
+	case string:
+		return t, nil
+	case bool:
+		return t, nil
+	}
+
+	return nil, ErrJSONSyntax
+}
+
+// Turns parsed JSON array elements into a typed slice
+func inferArray(values []Value) (Value, error) {
+	if len(values) == 0 {
+		return []Value{}, nil
+	}
+
+	var signed, unsigned, floats, strs, blobs, bools, sections, arrays int
+	for _, v := range values {
+		switch v.(type) {
+		case int64:
+			signed++
+		case uint64:
+			unsigned++
+		case float64:
+			floats++
+		case string:
+			strs++
+		case Blob:
+			blobs++
+		case bool:
+			bools++
+		case *Section:
+			sections++
+		default:
+			arrays++
+		}
+	}
+
+	l := len(values)
+	switch {
+	case strs+blobs == l:
+		// Arrays of binary strings are stored the same way as any other
+		result := make([]string, l)
+		for i, v := range values {
+			switch str := v.(type) {
+			case string:
+				result[i] = str
+			case Blob:
+				result[i] = string(str)
+			}
+		}
+		return result, nil
+	case bools == l:
+		result := make([]bool, l)
+		for i, v := range values {
+			result[i] = v.(bool)
+		}
+		return result, nil
+	case sections == l:
+		result := make([]*Section, l)
+		for i, v := range values {
+			result[i] = v.(*Section)
+		}
+		return result, nil
+	case arrays == l:
+		return values, nil
+	case unsigned == l:
+		result := make([]uint64, l)
+		for i, v := range values {
+			result[i] = v.(uint64)
+		}
+		return result, nil
+	case signed+unsigned == l:
+		result := make([]int64, l)
+		for i, v := range values {
+			switch n := v.(type) {
+			case int64:
+				result[i] = n
+			case uint64:
+				if n > math.MaxInt64 {
+					return nil, ErrOverflow
+				}
+				result[i] = int64(n)
+			}
+		}
+		return result, nil
+	case signed+unsigned+floats == l:
+		result := make([]float64, l)
+		for i, v := range values {
+			switch n := v.(type) {
+			case int64:
+				result[i] = float64(n)
+			case uint64:
+				result[i] = float64(n)
+			case float64:
+				result[i] = n
+			}
+		}
+		return result, nil
+	}
+
+	return nil, ErrBadArray
+}
+
+// Stores a parsed JSON value into v, converting it to the type of v
+func assignJSON(v reflect.Value, value Value) error {
+	if u, ok := asUnmarshaler(v); ok && !isTagged(v.Type()) {
+		return u.UnmarshalPortable(value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		s, ok := value.(*Section)
+		if !ok {
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		for _, f := range structFields(v.Type()) {
+			entry, present := s.Get(f.name)
+			if !present {
+				if f.optional {
+					continue
+				}
+				return fmt.Errorf("%s: %s", ErrEntryMissing, f.name)
+			}
+			if err := assignJSON(v.Field(f.index), entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if isBytes(v.Type()) {
+			return assignHex(v, value)
+		}
+		if v.Kind() == reflect.Array {
+			return ErrUnknownType
+		}
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice {
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		result := reflect.MakeSlice(v.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if err := assignJSON(result.Index(i), rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		v.Set(result)
+		return nil
+	case reflect.Float64:
+		switch n := value.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		case uint64:
+			v.SetFloat(float64(n))
+		default:
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		return nil
+	case reflect.String:
+		switch s := value.(type) {
+		case string:
+			v.SetString(s)
+		case Blob:
+			v.SetString(string(s))
+		default:
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		return nil
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		v.SetBool(b)
+		return nil
+	}
+
+	if isInteger(v.Kind()) {
+		switch n := value.(type) {
+		case int64:
+			return setInt(v, n)
+		case uint64:
+			return setUint(v, n)
+		}
+		return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+	}
+	return ErrUnknownType
+}
+
+// Stores a hex string or a binary string into a byte slice or a byte array
+func assignHex(v reflect.Value, value Value) error {
+	var data []byte
+	switch s := value.(type) {
+	case string:
+		decoded, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		data = decoded
+	case Blob:
+		data = s
+	default:
+		return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+	}
+	if v.Kind() == reflect.Slice {
+		v.SetBytes(data)
+		return nil
+	}
+	if v.Len() != len(data) {
+		return ErrBadBlob
+	}
+	reflect.Copy(v, reflect.ValueOf(data))
+	return nil
+}
@@ -0,0 +1,203 @@
+package portable
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	in := testAllValue()
+	data, err := ToJSON(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := testAll{}
+	if err := FromJSON(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("JSON round trip mismatch:\n%+v\n%+v\n%s", in, out, data)
+	}
+}
+
+func TestJSONPrecision(t *testing.T) {
+	type big struct {
+		U uint64 `store:"u"`
+		I int64  `store:"i"`
+	}
+
+	data, err := ToJSON(big{1<<64 - 1, -1 << 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"u":18446744073709551615,"i":-9223372036854775808}` {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	out := big{}
+	if err := FromJSON(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.U != 1<<64-1 || out.I != -1<<63 {
+		t.Errorf("precision lost: %+v", out)
+	}
+}
+
+func TestJSONSection(t *testing.T) {
+	data := []byte(`{"b":1,"a":[-1,2],"f":[1,2.5],"s":{"x":"y"},"e":[],"n":[[true],[false]]}`)
+	s := NewSection()
+	if err := FromJSON(data, s); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Value{
+		"b": uint64(1),
+		"a": []int64{-1, 2},
+		"f": []float64{1, 2.5},
+		"e": []Value{},
+		"n": []Value{[]bool{true}, []bool{false}},
+	}
+	for name, value := range expected {
+		if v, _ := s.Get(name); !reflect.DeepEqual(v, value) {
+			t.Errorf("%s = %#v, want %#v", name, v, value)
+		}
+	}
+
+	encoded, err := ToJSON(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != string(data) {
+		t.Errorf("order is not preserved:\n%s\n%s", data, encoded)
+	}
+}
+
+func TestJSONBinaryString(t *testing.T) {
+	type blob struct {
+		Data  string   `store:"data"`
+		Texts []string `store:"texts"`
+	}
+
+	in := blob{"\xff\xfe", []string{"text", "\x00\x80"}}
+	data, err := ToJSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"data":{"$blob":"fffe"},"texts":["text",{"$blob":"0080"}]}` {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	out := blob{}
+	if err := FromJSON(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	s := NewSection()
+	if err := FromJSON(data, s); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("data"); !reflect.DeepEqual(v, Blob{0xff, 0xfe}) {
+		t.Errorf("data = %#v, want a Blob", v)
+	}
+	if v, _ := s.Get("texts"); !reflect.DeepEqual(v, []string{"text", "\x00\x80"}) {
+		t.Errorf("texts = %#v", v)
+	}
+
+	// Names must be text, sections can't take the form of a binary string
+	bad := NewSection()
+	bad.Set("\xff", uint8(1))
+	if _, err := ToJSON(bad); err != ErrJSONString {
+		t.Errorf("err = %v, want %v", err, ErrJSONString)
+	}
+	marker := NewSection()
+	marker.Set("$blob", "00")
+	if _, err := ToJSON(marker); err != ErrJSONBlob {
+		t.Errorf("err = %v, want %v", err, ErrJSONBlob)
+	}
+	if err := FromJSON([]byte(`{"data":{"$blob":"0"}}`), NewSection()); err == nil {
+		t.Error("bad hex was accepted")
+	}
+}
+
+// Reads a fuzz seed, which is a single quoted []byte
+func readSeed(t *testing.T, name string) []byte {
+	file, err := os.ReadFile("testdata/fuzz/FuzzUnmarshal/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(file)), "\n")
+	quoted := strings.TrimSuffix(strings.TrimPrefix(lines[len(lines)-1], "[]byte("), ")")
+	data, err := strconv.Unquote(quoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(data)
+}
+
+func TestJSONHandshake(t *testing.T) {
+	for _, name := range []string{"handshake_request", "handshake_response"} {
+		data := readSeed(t, name)
+		s, err := UnmarshalSection(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := ToJSON(s)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		parsed := NewSection()
+		if err := FromJSON(j, parsed); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if again, _ := ToJSON(parsed); !bytes.Equal(j, again) {
+			t.Errorf("%s: JSON changed:\n%s\n%s", name, j, again)
+		}
+
+		// Only integer widths may differ, the decoded values are the same
+		encoded, err := MarshalSection(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, out := fuzzHandshake{}, fuzzHandshake{}
+		if err := Unmarshal(data, &in); err != nil {
+			t.Fatal(err)
+		}
+		if err := Unmarshal(encoded, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: handshake changed:\n%+v\n%+v", name, in, out)
+		}
+	}
+}
+
+func TestJSONBytes(t *testing.T) {
+	type hashes struct {
+		Hash [4]byte  `store:"hash"`
+		Key  []byte   `store:"key"`
+		Ids  []uint64 `store:"ids,blob"`
+	}
+
+	in := hashes{[4]byte{0xde, 0xad, 0xbe, 0xef}, []byte{1}, []uint64{7}}
+	data, err := ToJSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"hash":"deadbeef","key":"01","ids":[7]}` {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	out := hashes{}
+	if err := FromJSON(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+}
@@ -0,0 +1,131 @@
+package portable
+
+import (
+	"bytes"
+	"io"
+)
+
+// Limits bound the resources spent on decoding a single storage, so a
+// malicious peer can't exhaust memory or stack. Zero fields are not limited
+type Limits struct {
+	MaxDepth        int    // nesting of objects and arrays
+	MaxElements     uint64 // object entries and elements of arrays of objects or arrays, in total
+	MaxStringLength uint64 // length of a single string
+	MaxBytes        int64  // size of the whole storage
+}
+
+// DefaultLimits are used by Unmarshal, UnmarshalSection and new Decoders.
+// They are well above anything the reference node sends, a storage can't
+// exceed a fragmented levin packet anyway
+var DefaultLimits = Limits{
+	MaxDepth:        100,
+	MaxElements:     1 << 18,
+	MaxStringLength: 16 << 20,
+	MaxBytes:        64 << 20,
+}
+
+// Decoder input, which keeps track of the resources spent against the limits
+type reader struct {
+	r        io.Reader
+	limits   Limits
+	read     int64
+	depth    int
+	elements uint64
+
+	scratch [8]byte
+	name    [255]byte
+}
+
+func newReader(r io.Reader, limits Limits) *reader {
+	return &reader{r: r, limits: limits}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.limits.MaxBytes > 0 {
+		left := r.limits.MaxBytes - r.read
+		if left <= 0 {
+			return 0, ErrTooBig
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// Goes one object or array deeper. Must be paired with leave
+func (r *reader) enter() error {
+	r.depth++
+	if r.limits.MaxDepth > 0 && r.depth > r.limits.MaxDepth {
+		return ErrTooDeep
+	}
+	return nil
+}
+
+func (r *reader) leave() {
+	r.depth--
+}
+
+// Accounts for n more object entries or elements of arrays of objects or
+// arrays
+func (r *reader) addElements(n uint64) error {
+	if r.limits.MaxElements > 0 && n > r.limits.MaxElements-r.elements {
+		return ErrTooMany
+	}
+	r.elements += n
+	return nil
+}
+
+// Accounts for an array of count elements of valueType. Plain values are
+// cheap to keep, so large arrays of them are only checked against the bytes
+// left, each element taking at least its size (strings at least a byte)
+func (r *reader) addArray(count uint64, valueType uint8) error {
+	switch valueType {
+	case serializeTypeObject, serializeTypeArray:
+		return r.addElements(count)
+	}
+	size, ok := serializeTypeSize[valueType]
+	if !ok {
+		size = 1
+	}
+	if r.limits.MaxBytes > 0 && count > uint64(r.limits.MaxBytes-r.read)/uint64(size) {
+		return ErrTooBig
+	}
+	return nil
+}
+
+// Reads a string value. Its length is checked before anything is allocated
+func (r *reader) readString() ([]byte, error) {
+	length, err := decodeVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.limits.MaxStringLength > 0 && length > r.limits.MaxStringLength {
+		return nil, ErrTooLong
+	}
+	if r.limits.MaxBytes > 0 && length > uint64(r.limits.MaxBytes-r.read) {
+		return nil, ErrTooBig
+	}
+
+	if length > 1<<16 {
+		// Grow along with the data actually read, limits may be off
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, r, int64(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"reflect"
 )
 
@@ -15,12 +16,33 @@ func Marshal(v interface{}) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-func encode(w io.Writer, v interface{}) error {
+func encode(out io.Writer, v interface{}) error {
+	w := newWriter(out)
 	if err := binary.Write(w, binary.LittleEndian, storageHeader{storageSignature, 1}); err != nil {
 		return err
 	}
+	if s, ok := v.(*Section); ok {
+		return encodeSection(w, s)
+	}
+	if m, ok := v.(ObjectMarshaler); ok {
+		return encodeObject(w, m)
+	}
 
-	rv := reflect.Indirect(reflect.ValueOf(v))
+	rv := addressable(reflect.Indirect(reflect.ValueOf(v)))
+	if m, ok := asObjectMarshaler(rv); ok {
+		return encodeObject(w, m)
+	}
+	if m, ok := asMarshaler(rv); ok {
+		value, err := m.MarshalPortable()
+		if err != nil {
+			return err
+		}
+		s, ok := value.(*Section)
+		if !ok {
+			return ErrBadRoot
+		}
+		return encodeSection(w, s)
+	}
 	if err := encodeStruct(w, rv); err != nil {
 		return err
 	}
@@ -28,16 +50,15 @@ func encode(w io.Writer, v interface{}) error {
 	return nil
 }
 
-func encodeStruct(w io.Writer, v reflect.Value) error {
+func encodeStruct(w *writer, v reflect.Value) error {
 	if v.Kind() != reflect.Struct {
 		return ErrBadRoot
 	}
 
-	t := v.Type()
-	l := v.NumField()
+	fields := structFields(v.Type())
 	entryCount := uint64(0)
-	for i := 0; i < l; i++ {
-		if _, ok := t.Field(i).Tag.Lookup("store"); ok {
+	for _, f := range fields {
+		if !f.omitEmpty || !v.Field(f.index).IsZero() {
 			entryCount++
 		}
 	}
@@ -46,107 +67,216 @@ func encodeStruct(w io.Writer, v reflect.Value) error {
 		return err
 	}
 
-	for i := 0; i < l; i++ {
-		if tag, ok := t.Field(i).Tag.Lookup("store"); ok {
-			if len(tag) > 0xff {
-				return ErrSecName
-			}
-			if err := binary.Write(w, binary.LittleEndian, uint8(len(tag))); err != nil {
-				return err
-			}
-			if err := binary.Write(w, binary.LittleEndian, []byte(tag)); err != nil {
-				return err
-			}
-			if err := encodeValue(w, v.Field(i)); err != nil {
+	for _, f := range fields {
+		if f.omitEmpty && v.Field(f.index).IsZero() {
+			continue
+		}
+		if len(f.name) > 0xff {
+			return ErrSecName
+		}
+		if err := w.writeUint8(uint8(len(f.name))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w.w, f.name); err != nil {
+			return err
+		}
+		if f.blob {
+			if err := encodeBlob(w, v.Field(f.index)); err != nil {
 				return err
 			}
+		} else if err := encodeValue(w, v.Field(f.index)); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func encodeValue(w io.Writer, v reflect.Value) error {
-	switch v.Kind() {
-	case reflect.Struct:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeObject)); err != nil {
-			return err
-		}
-		return encodeStruct(w, v)
-	case reflect.String:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeString)); err != nil {
+// Writes the serialize type of v followed by the value itself
+func encodeValue(w *writer, v reflect.Value) error {
+	if m, ok := asObjectMarshaler(v); ok {
+		if err := w.writeUint8(serializeTypeObject); err != nil {
 			return err
 		}
-		if err := encodeVarint(w, uint64(len(v.String()))); err != nil {
+		return encodeObject(w, m)
+	}
+	if m, ok := asMarshaler(v); ok {
+		value, err := m.MarshalPortable()
+		if err != nil {
 			return err
 		}
-		if err := binary.Write(w, binary.LittleEndian, []byte(v.String())); err != nil {
+		return encodeDynamic(w, value)
+	}
+	if v.Kind() == reflect.Slice && isMarshaler(v.Type().Elem()) {
+		value, err := marshalArray(v)
+		if err != nil {
 			return err
 		}
+		return encodeDynamic(w, value)
+	}
+
+	valueType, err := serializeTypeOf(v.Type())
+	if err != nil {
+		return err
+	}
+	if err := w.writeUint8(valueType); err != nil {
+		return err
+	}
+	return encodeRaw(w, v)
+}
+
+// Returns the serialize type for values of type t. Byte slices and byte
+// arrays are strings. Other slices are arrays of their element type, and
+// slices of those are arrays of arrays
+func serializeTypeOf(t reflect.Type) (uint8, error) {
+	switch t.Kind() {
+	case reflect.Struct:
+		return serializeTypeObject, nil
+	case reflect.String:
+		return serializeTypeString, nil
 	case reflect.Int64:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeInt64)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, int64(v.Int()))
+		return serializeTypeInt64, nil
 	case reflect.Int32:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeInt32)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, int32(v.Int()))
+		return serializeTypeInt32, nil
 	case reflect.Int16:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeInt16)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, int16(v.Int()))
+		return serializeTypeInt16, nil
 	case reflect.Int8:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeInt8)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, int8(v.Int()))
+		return serializeTypeInt8, nil
 	case reflect.Uint64:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeUint64)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, uint64(v.Uint()))
+		return serializeTypeUint64, nil
 	case reflect.Uint32:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeUint32)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, uint32(v.Uint()))
+		return serializeTypeUint32, nil
 	case reflect.Uint16:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeUint16)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, uint16(v.Uint()))
+		return serializeTypeUint16, nil
 	case reflect.Uint8:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeUint8)); err != nil {
-			return err
-		}
-		return binary.Write(w, binary.LittleEndian, uint8(v.Uint()))
+		return serializeTypeUint8, nil
 	case reflect.Float64:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeFloat64)); err != nil {
-			return err
+		return serializeTypeFloat64, nil
+	case reflect.Bool:
+		return serializeTypeBool, nil
+	case reflect.Array:
+		if isBytes(t) {
+			return serializeTypeString, nil
+		}
+	case reflect.Slice:
+		if isBytes(t) {
+			return serializeTypeString, nil
+		}
+		if isArray(t.Elem()) {
+			return serializeTypeArray | serializeArrayMask, nil
+		}
+		elemType, err := serializeTypeOf(t.Elem())
+		if err != nil {
+			return 0, err
+		}
+		return elemType | serializeArrayMask, nil
+	}
+
+	return 0, ErrUnknownType
+}
+
+// Writes the value without its serialize type
+func encodeRaw(w *writer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		if m, ok := asObjectMarshaler(v); ok {
+			return encodeObject(w, m)
 		}
-		return binary.Write(w, binary.LittleEndian, float64(v.Float()))
+		return encodeStruct(w, v)
+	case reflect.String:
+		return w.writeString(v.String())
+	case reflect.Int64:
+		return w.writeUint(uint64(v.Int()), 8)
+	case reflect.Int32:
+		return w.writeUint(uint64(v.Int()), 4)
+	case reflect.Int16:
+		return w.writeUint(uint64(v.Int()), 2)
+	case reflect.Int8:
+		return w.writeUint(uint64(v.Int()), 1)
+	case reflect.Uint64:
+		return w.writeUint(v.Uint(), 8)
+	case reflect.Uint32:
+		return w.writeUint(v.Uint(), 4)
+	case reflect.Uint16:
+		return w.writeUint(v.Uint(), 2)
+	case reflect.Uint8:
+		return w.writeUint(v.Uint(), 1)
+	case reflect.Float64:
+		return w.writeUint(math.Float64bits(v.Float()), 8)
 	case reflect.Bool:
-		if err := binary.Write(w, binary.LittleEndian, uint8(serializeTypeBool)); err != nil {
-			return err
+		if v.Bool() {
+			return w.writeUint8(1)
+		}
+		return w.writeUint8(0)
+	case reflect.Slice, reflect.Array:
+		if isBytes(v.Type()) {
+			return encodeBytes(w, v)
+		}
+		if v.Kind() == reflect.Slice {
+			return encodeArray(w, v)
 		}
-		return binary.Write(w, binary.LittleEndian, bool(v.Bool()))
 	}
 
+	return ErrUnknownType
+}
+
+// Writes a byte slice or a byte array as a string
+func encodeBytes(w *writer, v reflect.Value) error {
+	data := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(data), v)
+	if err := encodeVarint(w, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Packs a fixed-size value or a slice of those into a single string, the same
+// way epee does for POD containers (block ids, output indices...)
+func encodeBlob(w *writer, v reflect.Value) error {
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, v.Interface()); err != nil {
+		return ErrBadBlob
+	}
+	if err := w.writeUint8(serializeTypeString); err != nil {
+		return err
+	}
+	if err := encodeVarint(w, uint64(b.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Writes element count followed by the elements. Nested arrays carry their
+// own serialize type, plain values don't
+func encodeArray(w *writer, v reflect.Value) error {
+	l := v.Len()
+	if err := encodeVarint(w, uint64(l)); err != nil {
+		return err
+	}
+	nested := isArray(v.Type().Elem())
+	for i := 0; i < l; i++ {
+		if nested {
+			if err := encodeValue(w, v.Index(i)); err != nil {
+				return err
+			}
+		} else if err := encodeRaw(w, v.Index(i)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func encodeVarint(w io.Writer, value uint64) error {
+func encodeVarint(w *writer, value uint64) error {
 	if value <= 0x3f {
-		return binary.Write(w, binary.LittleEndian, uint8(value<<2)|uint8(portableVarint8))
+		return w.writeUint(value<<2|portableVarint8, 1)
 	} else if value <= 0x3fff {
-		return binary.Write(w, binary.LittleEndian, uint16(value<<2)|uint16(portableVarint16))
+		return w.writeUint(value<<2|portableVarint16, 2)
 	} else if value <= 0x3fffffff {
-		return binary.Write(w, binary.LittleEndian, uint32(value<<2)|uint32(portableVarint32))
+		return w.writeUint(value<<2|portableVarint32, 4)
 	} else if value <= 0x3fffffffffffffff {
-		return binary.Write(w, binary.LittleEndian, uint64(value<<2)|uint64(portableVarint64))
+		return w.writeUint(value<<2|portableVarint64, 8)
 	}
 
 	return ErrBadVarint
@@ -0,0 +1,131 @@
+package portable
+
+import (
+	"reflect"
+)
+
+// Marshaler is implemented by types that control their own encoding.
+// MarshalPortable returns a dynamic value (see Value) which is stored in
+// place of the receiver. Byte strings should be returned as string, []uint8
+// is an array of numbers
+type Marshaler interface {
+	MarshalPortable() (Value, error)
+}
+
+// Unmarshaler is implemented by types that control their own decoding.
+// UnmarshalPortable receives the entry decoded without a schema, so integers
+// come with their wire width and should be read with the lenient Section
+// accessors
+type Unmarshaler interface {
+	UnmarshalPortable(v Value) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// Returns the Marshaler of v, looking at pointer receivers if v is
+// addressable
+func asMarshaler(v reflect.Value) (Marshaler, bool) {
+	if !v.CanInterface() {
+		return nil, false
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler), true
+	}
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, false
+		}
+		return v.Interface().(Marshaler), true
+	}
+	return nil, false
+}
+
+// Returns the Unmarshaler of v. Only pointer receivers can modify v, so v
+// must be addressable
+func asUnmarshaler(v reflect.Value) (Unmarshaler, bool) {
+	if !v.CanAddr() || !v.CanInterface() {
+		return nil, false
+	}
+	if v.Addr().Type().Implements(unmarshalerType) {
+		return v.Addr().Interface().(Unmarshaler), true
+	}
+	return nil, false
+}
+
+// Returns the ObjectMarshaler of v. Generated methods have pointer
+// receivers, so v must be addressable
+func asObjectMarshaler(v reflect.Value) (ObjectMarshaler, bool) {
+	if !v.CanAddr() || !v.CanInterface() {
+		return nil, false
+	}
+	m, ok := v.Addr().Interface().(ObjectMarshaler)
+	return m, ok
+}
+
+func asObjectUnmarshaler(v reflect.Value) (ObjectUnmarshaler, bool) {
+	if !v.CanAddr() || !v.CanInterface() {
+		return nil, false
+	}
+	u, ok := v.Addr().Interface().(ObjectUnmarshaler)
+	return u, ok
+}
+
+func isMarshaler(t reflect.Type) bool {
+	return t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType)
+}
+
+func isUnmarshaler(t reflect.Type) bool {
+	return reflect.PtrTo(t).Implements(unmarshalerType)
+}
+
+// Returns a copy of v that can be addressed, so pointer receivers are found
+// for values passed to Marshal directly
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Elem()
+}
+
+// Marshals every element of slice v and collects the results into a typed
+// slice, which is what encodeDynamic expects. All elements must marshal to
+// the same type. Empty slices are written as arrays of objects
+func marshalArray(v reflect.Value) (Value, error) {
+	if v.Len() == 0 {
+		return []*Section{}, nil
+	}
+
+	values := make([]Value, v.Len())
+	for i := range values {
+		m, ok := asMarshaler(v.Index(i))
+		if !ok {
+			return nil, ErrUnknownType
+		}
+		value, err := m.MarshalPortable()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	if isDynamicArray(values[0]) {
+		return values, nil
+	}
+
+	t := reflect.TypeOf(values[0])
+	if t == nil {
+		return nil, ErrUnknownType
+	}
+	slice := reflect.MakeSlice(reflect.SliceOf(t), len(values), len(values))
+	for i, value := range values {
+		if reflect.TypeOf(value) != t {
+			return nil, ErrBadArray
+		}
+		slice.Index(i).Set(reflect.ValueOf(value))
+	}
+	return slice.Interface(), nil
+}
@@ -0,0 +1,597 @@
+package portable
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ObjectMarshaler is implemented by the code emitted by cmd/portable-gen. It
+// writes entries of the object straight to the output, no Section is built
+type ObjectMarshaler interface {
+	MarshalPortableObject(w *ObjectWriter) error
+}
+
+// ObjectUnmarshaler is implemented by the code emitted by cmd/portable-gen. It
+// reads entries of the object one by one as they come from the input
+type ObjectUnmarshaler interface {
+	UnmarshalPortableObject(r *ObjectReader) error
+}
+
+// ObjectWriter writes an object entry by entry. Begin goes first with the
+// number of entries that follow. Errors are sticky: once a write fails the
+// rest are ignored and Err reports the failure
+type ObjectWriter struct {
+	w   *writer
+	err error
+}
+
+func encodeObject(w *writer, m ObjectMarshaler) error {
+	o := &ObjectWriter{w: w}
+	if err := m.MarshalPortableObject(o); err != nil {
+		return err
+	}
+	return o.err
+}
+
+func (o *ObjectWriter) Err() error {
+	return o.err
+}
+
+// Begin writes the number of entries of the object
+func (o *ObjectWriter) Begin(entries int) {
+	if o.err == nil {
+		o.err = encodeVarint(o.w, uint64(entries))
+	}
+}
+
+// Writes the entry name. Returns false if the writer has failed
+func (o *ObjectWriter) name(name string) bool {
+	if o.err != nil {
+		return false
+	}
+	if len(name) > 0xff {
+		o.err = ErrSecName
+		return false
+	}
+	if o.err = o.w.writeUint8(uint8(len(name))); o.err != nil {
+		return false
+	}
+	_, o.err = io.WriteString(o.w.w, name)
+	return o.err == nil
+}
+
+// Writes the entry name followed by the serialize type
+func (o *ObjectWriter) entry(name string, valueType uint8) bool {
+	if !o.name(name) {
+		return false
+	}
+	o.err = o.w.writeUint8(valueType)
+	return o.err == nil
+}
+
+func (o *ObjectWriter) Uint64(name string, v uint64) {
+	if o.entry(name, serializeTypeUint64) {
+		o.err = o.w.writeUint(v, 8)
+	}
+}
+
+func (o *ObjectWriter) Uint32(name string, v uint32) {
+	if o.entry(name, serializeTypeUint32) {
+		o.err = o.w.writeUint(uint64(v), 4)
+	}
+}
+
+func (o *ObjectWriter) Uint16(name string, v uint16) {
+	if o.entry(name, serializeTypeUint16) {
+		o.err = o.w.writeUint(uint64(v), 2)
+	}
+}
+
+func (o *ObjectWriter) Uint8(name string, v uint8) {
+	if o.entry(name, serializeTypeUint8) {
+		o.err = o.w.writeUint8(v)
+	}
+}
+
+func (o *ObjectWriter) Int64(name string, v int64) {
+	if o.entry(name, serializeTypeInt64) {
+		o.err = o.w.writeUint(uint64(v), 8)
+	}
+}
+
+func (o *ObjectWriter) Int32(name string, v int32) {
+	if o.entry(name, serializeTypeInt32) {
+		o.err = o.w.writeUint(uint64(v), 4)
+	}
+}
+
+func (o *ObjectWriter) Int16(name string, v int16) {
+	if o.entry(name, serializeTypeInt16) {
+		o.err = o.w.writeUint(uint64(v), 2)
+	}
+}
+
+func (o *ObjectWriter) Int8(name string, v int8) {
+	if o.entry(name, serializeTypeInt8) {
+		o.err = o.w.writeUint8(uint8(v))
+	}
+}
+
+func (o *ObjectWriter) Float64(name string, v float64) {
+	if o.entry(name, serializeTypeFloat64) {
+		o.err = o.w.writeUint(math.Float64bits(v), 8)
+	}
+}
+
+func (o *ObjectWriter) Bool(name string, v bool) {
+	if o.entry(name, serializeTypeBool) {
+		if v {
+			o.err = o.w.writeUint8(1)
+		} else {
+			o.err = o.w.writeUint8(0)
+		}
+	}
+}
+
+func (o *ObjectWriter) String(name string, v string) {
+	if o.entry(name, serializeTypeString) {
+		o.err = o.w.writeString(v)
+	}
+}
+
+// Bytes writes a byte slice or a byte array as a string
+func (o *ObjectWriter) Bytes(name string, v []byte) {
+	if !o.entry(name, serializeTypeString) {
+		return
+	}
+	if o.err = encodeVarint(o.w, uint64(len(v))); o.err == nil {
+		_, o.err = o.w.Write(v)
+	}
+}
+
+// Array writes a typed slice of plain values, see Value
+func (o *ObjectWriter) Array(name string, v Value) {
+	if !isDynamicArray(v) {
+		o.err = ErrBadArray
+		return
+	}
+	if o.name(name) {
+		o.err = encodeDynamic(o.w, v)
+	}
+}
+
+func (o *ObjectWriter) Object(name string, v ObjectMarshaler) {
+	if o.entry(name, serializeTypeObject) {
+		o.ObjectElement(v)
+	}
+}
+
+// Value writes the dynamic value returned by v
+func (o *ObjectWriter) Value(name string, v Marshaler) {
+	if o.err != nil {
+		return
+	}
+	value, err := v.MarshalPortable()
+	if err != nil {
+		o.err = err
+		return
+	}
+	if o.name(name) {
+		o.err = encodeDynamic(o.w, value)
+	}
+}
+
+// Objects begins an array of count objects, each written with ObjectElement
+// or ValueElement
+func (o *ObjectWriter) Objects(name string, count int) {
+	if o.entry(name, serializeTypeObject|serializeArrayMask) {
+		o.err = encodeVarint(o.w, uint64(count))
+	}
+}
+
+func (o *ObjectWriter) ObjectElement(v ObjectMarshaler) {
+	if o.err == nil {
+		o.err = v.MarshalPortableObject(o)
+	}
+}
+
+// ValueElement writes an array element of v, which must marshal to a
+// *Section
+func (o *ObjectWriter) ValueElement(v Marshaler) {
+	if o.err != nil {
+		return
+	}
+	value, err := v.MarshalPortable()
+	if err != nil {
+		o.err = err
+		return
+	}
+	s, ok := value.(*Section)
+	if !ok {
+		o.err = ErrBadArray
+		return
+	}
+	o.err = encodeSection(o.w, s)
+}
+
+// ObjectReader reads an object entry by entry:
+//
+//	for r.Next(names) {
+//		switch r.Index() {
+//		case 0:
+//			m.Height = r.Uint64()
+//		...
+//		}
+//	}
+//	return r.End(required...)
+//
+// Entries with names not listed are skipped. Values are converted the same
+// way the reflective decoder does. Errors are sticky: once reading fails the
+// rest returns zero values, Next stops and End reports the failure
+type ObjectReader struct {
+	r   *reader
+	err error
+	object
+}
+
+// Position inside the object being read
+type object struct {
+	names     []string
+	entries   uint64 // left to read
+	index     int    // of the current entry in names
+	seen      uint64 // bit set of the names read, only the first 64 are tracked
+	elements  uint64 // left to read in the current array
+	array     bool   // inside an array
+	valueType uint8  // of the current entry or array element
+	pending   bool   // current value is not read yet
+}
+
+func decodeObject(r *reader, u ObjectUnmarshaler) error {
+	o := &ObjectReader{r: r}
+	o.valueType = serializeTypeObject
+	o.pending = true
+	o.Object(u)
+	return o.err
+}
+
+// Next advances to the next entry with one of the names and returns false
+// once the object is over
+func (o *ObjectReader) Next(names []string) bool {
+	if o.err != nil {
+		return false
+	}
+	o.names = names
+	if o.pending {
+		o.skip()
+	}
+	for o.err == nil && o.entries > 0 {
+		o.entries--
+		size, err := o.r.readUint8()
+		if err != nil {
+			o.err = err
+			return false
+		}
+		name := o.r.name[:size]
+		if _, err := io.ReadFull(o.r, name); err != nil {
+			o.err = err
+			return false
+		}
+		if o.valueType, o.err = o.r.readUint8(); o.err != nil {
+			return false
+		}
+		o.pending = true
+
+		o.index = -1
+		for i := range names {
+			if string(name) == names[i] {
+				o.index = i
+				break
+			}
+		}
+		if o.index < 0 {
+			o.skip()
+			continue
+		}
+		if o.index < 64 {
+			if o.seen&(1<<o.index) != 0 {
+				o.err = fmt.Errorf("%s: %s", ErrEntryMissing, names[o.index])
+				return false
+			}
+			o.seen |= 1 << o.index
+		}
+		return true
+	}
+	return false
+}
+
+// Index returns the position of the current entry name in the names given
+// to Next
+func (o *ObjectReader) Index() int {
+	return o.index
+}
+
+// End returns the first error met while reading the object, or reports the
+// first of the required names which has not been read
+func (o *ObjectReader) End(required ...int) error {
+	if o.err != nil {
+		return o.err
+	}
+	for _, i := range required {
+		if i < 64 && o.seen&(1<<i) == 0 {
+			return fmt.Errorf("%s: %s", ErrEntryMissing, o.names[i])
+		}
+	}
+	return nil
+}
+
+// Discards the current value
+func (o *ObjectReader) skip() {
+	o.pending = false
+	if o.valueType&serializeArrayMask != 0 {
+		o.err = skipArray(o.r, o.valueType&^serializeArrayMask)
+	} else {
+		o.err = skipValue(o.r, o.valueType)
+	}
+}
+
+// Starts reading the current value. Returns false if it is not there
+func (o *ObjectReader) take() bool {
+	if o.err != nil {
+		return false
+	}
+	if !o.pending {
+		o.err = ErrEntryMissing
+		return false
+	}
+	o.pending = false
+	return true
+}
+
+func (o *ObjectReader) mismatch() {
+	name := ""
+	if o.index >= 0 && o.index < len(o.names) {
+		name = o.names[o.index]
+	}
+	o.err = fmt.Errorf("%s: %s", ErrTypeMismatch, name)
+}
+
+// Reads an integer of any type as its magnitude and sign
+func (o *ObjectReader) integer() (uint64, bool) {
+	if !o.take() {
+		return 0, false
+	}
+	switch o.valueType {
+	case serializeTypeUint64, serializeTypeUint32, serializeTypeUint16, serializeTypeUint8:
+		value, err := o.r.readUint(int(serializeTypeSize[o.valueType]))
+		o.err = err
+		return value, false
+	case serializeTypeInt64, serializeTypeInt32, serializeTypeInt16, serializeTypeInt8:
+		value, err := o.r.readInt(int(serializeTypeSize[o.valueType]))
+		o.err = err
+		magnitude, negative, _ := signed(value)
+		return magnitude, negative
+	}
+	o.mismatch()
+	return 0, false
+}
+
+func (o *ObjectReader) uintValue(bits int) uint64 {
+	magnitude, negative := o.integer()
+	if o.err != nil {
+		return 0
+	}
+	value, err := toUint(magnitude, negative, bits)
+	o.err = err
+	return value
+}
+
+func (o *ObjectReader) intValue(bits int) int64 {
+	magnitude, negative := o.integer()
+	if o.err != nil {
+		return 0
+	}
+	value, err := toInt(magnitude, negative, bits)
+	o.err = err
+	return value
+}
+
+func (o *ObjectReader) Uint64() uint64 {
+	return o.uintValue(64)
+}
+
+func (o *ObjectReader) Uint32() uint32 {
+	return uint32(o.uintValue(32))
+}
+
+func (o *ObjectReader) Uint16() uint16 {
+	return uint16(o.uintValue(16))
+}
+
+func (o *ObjectReader) Uint8() uint8 {
+	return uint8(o.uintValue(8))
+}
+
+func (o *ObjectReader) Int64() int64 {
+	return o.intValue(64)
+}
+
+func (o *ObjectReader) Int32() int32 {
+	return int32(o.intValue(32))
+}
+
+func (o *ObjectReader) Int16() int16 {
+	return int16(o.intValue(16))
+}
+
+func (o *ObjectReader) Int8() int8 {
+	return int8(o.intValue(8))
+}
+
+func (o *ObjectReader) Float64() float64 {
+	if !o.take() {
+		return 0
+	}
+	if o.valueType != serializeTypeFloat64 {
+		o.mismatch()
+		return 0
+	}
+	value, err := o.r.readFloat64()
+	o.err = err
+	return value
+}
+
+func (o *ObjectReader) Bool() bool {
+	if !o.take() {
+		return false
+	}
+	if o.valueType != serializeTypeBool {
+		o.mismatch()
+		return false
+	}
+	value, err := o.r.readBool()
+	o.err = err
+	return value
+}
+
+func (o *ObjectReader) String() string {
+	return string(o.Bytes())
+}
+
+// Bytes reads a string value into a new byte slice
+func (o *ObjectReader) Bytes() []byte {
+	if !o.take() {
+		return nil
+	}
+	if o.valueType != serializeTypeString {
+		o.mismatch()
+		return nil
+	}
+	value, err := o.r.readString()
+	o.err = err
+	return value
+}
+
+// ByteArray reads a string value into v, which must be of the same length
+func (o *ObjectReader) ByteArray(v []byte) {
+	if !o.take() {
+		return
+	}
+	if o.valueType != serializeTypeString {
+		o.mismatch()
+		return
+	}
+	length, err := decodeVarint(o.r)
+	if err != nil {
+		o.err = err
+		return
+	}
+	if length != uint64(len(v)) {
+		o.err = ErrBadBlob
+		return
+	}
+	_, o.err = io.ReadFull(o.r, v)
+}
+
+func (o *ObjectReader) Object(v ObjectUnmarshaler) {
+	if !o.take() {
+		return
+	}
+	if o.valueType != serializeTypeObject {
+		o.mismatch()
+		return
+	}
+	if o.err = o.r.enter(); o.err != nil {
+		return
+	}
+	count, err := decodeVarint(o.r)
+	if err != nil {
+		o.err = err
+		return
+	}
+	if o.err = o.r.addElements(count); o.err != nil {
+		return
+	}
+
+	parent := o.object
+	o.object = object{entries: count}
+	if err := v.UnmarshalPortableObject(o); err != nil {
+		o.err = err
+		return
+	}
+	// Entries v has left unread
+	for o.Next(nil) {
+	}
+	if o.err != nil {
+		return
+	}
+	o.object = parent
+	o.r.leave()
+}
+
+// Value reads the current value without a schema and passes it to v
+func (o *ObjectReader) Value(v Unmarshaler) {
+	if !o.take() {
+		return
+	}
+	var value Value
+	var err error
+	if o.valueType&serializeArrayMask != 0 {
+		value, err = decodeDynamicArray(o.r, o.valueType&^serializeArrayMask)
+	} else {
+		value, err = decodeDynamicValue(o.r, o.valueType)
+	}
+	if err != nil {
+		o.err = err
+		return
+	}
+	o.err = v.UnmarshalPortable(value)
+}
+
+// Array starts reading an array of plain values or objects. Its elements
+// are read with NextElement, all of them must be read. Returns the number of
+// elements to preallocate, which is capped in case the count is bogus
+func (o *ObjectReader) Array() int {
+	if !o.take() {
+		return 0
+	}
+	if o.array || o.valueType&serializeArrayMask == 0 {
+		o.mismatch()
+		return 0
+	}
+	if o.err = o.r.enter(); o.err != nil {
+		return 0
+	}
+	count, err := decodeVarint(o.r)
+	if err != nil {
+		o.err = err
+		return 0
+	}
+	o.valueType &^= serializeArrayMask
+	if o.err = o.r.addArray(count, o.valueType); o.err != nil {
+		return 0
+	}
+	o.elements = count
+	o.array = true
+	if count > 1024 {
+		return 1024
+	}
+	return int(count)
+}
+
+// NextElement advances to the next array element and returns false once the
+// array is over
+func (o *ObjectReader) NextElement() bool {
+	if o.err != nil || !o.array {
+		return false
+	}
+	if o.elements == 0 {
+		o.array = false
+		o.pending = false
+		o.r.leave()
+		return false
+	}
+	o.elements--
+	o.pending = true
+	return true
+}
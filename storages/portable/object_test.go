@@ -0,0 +1,264 @@
+package portable
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Written by hand the way cmd/portable-gen does, mirrors testObjectMirror
+type testObject struct {
+	U64     uint64
+	I8      int8
+	F64     float64
+	Bool    bool
+	Str     string
+	Hash    [4]byte
+	Data    []byte
+	Ints    []uint64
+	Inner   testObjectInner
+	Inners  []testObjectInner
+	Version testVersion
+	Note    string
+}
+
+type testObjectInner struct {
+	Name  string
+	Value uint32
+}
+
+type testObjectMirror struct {
+	U64     uint64      `store:"u64"`
+	I8      int8        `store:"i8"`
+	F64     float64     `store:"f64"`
+	Bool    bool        `store:"bool"`
+	Str     string      `store:"str"`
+	Hash    [4]byte     `store:"hash"`
+	Data    []byte      `store:"data"`
+	Ints    []uint64    `store:"ints"`
+	Inner   testInner   `store:"inner"`
+	Inners  []testInner `store:"inners"`
+	Version testVersion `store:"version"`
+	Note    string      `store:"note,omitempty"`
+}
+
+func (m *testObject) MarshalPortableObject(w *ObjectWriter) error {
+	entries := 11
+	if m.Note != "" {
+		entries++
+	}
+	w.Begin(entries)
+	w.Uint64("u64", m.U64)
+	w.Int8("i8", m.I8)
+	w.Float64("f64", m.F64)
+	w.Bool("bool", m.Bool)
+	w.String("str", m.Str)
+	w.Bytes("hash", m.Hash[:])
+	w.Bytes("data", m.Data)
+	w.Array("ints", m.Ints)
+	w.Object("inner", &m.Inner)
+	w.Objects("inners", len(m.Inners))
+	for i := range m.Inners {
+		w.ObjectElement(&m.Inners[i])
+	}
+	w.Value("version", &m.Version)
+	if m.Note != "" {
+		w.String("note", m.Note)
+	}
+	return w.Err()
+}
+
+var testObjectEntries = []string{"u64", "i8", "f64", "bool", "str", "hash", "data", "ints", "inner", "inners", "version", "note"}
+
+func (m *testObject) UnmarshalPortableObject(r *ObjectReader) error {
+	for r.Next(testObjectEntries) {
+		switch r.Index() {
+		case 0:
+			m.U64 = r.Uint64()
+		case 1:
+			m.I8 = r.Int8()
+		case 2:
+			m.F64 = r.Float64()
+		case 3:
+			m.Bool = r.Bool()
+		case 4:
+			m.Str = r.String()
+		case 5:
+			r.ByteArray(m.Hash[:])
+		case 6:
+			m.Data = r.Bytes()
+		case 7:
+			m.Ints = make([]uint64, 0, r.Array())
+			for r.NextElement() {
+				m.Ints = append(m.Ints, r.Uint64())
+			}
+		case 8:
+			r.Object(&m.Inner)
+		case 9:
+			m.Inners = make([]testObjectInner, 0, r.Array())
+			for r.NextElement() {
+				m.Inners = append(m.Inners, testObjectInner{})
+				r.Object(&m.Inners[len(m.Inners)-1])
+			}
+		case 10:
+			r.Value(&m.Version)
+		case 11:
+			m.Note = r.String()
+		}
+	}
+	return r.End(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+}
+
+func (m *testObjectInner) MarshalPortableObject(w *ObjectWriter) error {
+	w.Begin(2)
+	w.String("name", m.Name)
+	w.Uint32("value", m.Value)
+	return w.Err()
+}
+
+var testObjectInnerEntries = []string{"name", "value"}
+
+func (m *testObjectInner) UnmarshalPortableObject(r *ObjectReader) error {
+	for r.Next(testObjectInnerEntries) {
+		switch r.Index() {
+		case 0:
+			m.Name = r.String()
+		case 1:
+			m.Value = r.Uint32()
+		}
+	}
+	return r.End(0, 1)
+}
+
+func testObjectValue() testObject {
+	return testObject{
+		U64: 1 << 62, I8: -5, F64: 3.25, Bool: true,
+		Str:     "hello",
+		Hash:    [4]byte{0xde, 0xad, 0xbe, 0xef},
+		Data:    []byte{0, 1, 2},
+		Ints:    []uint64{0, 1, 1 << 63},
+		Inner:   testObjectInner{"inner", 7},
+		Inners:  []testObjectInner{{"x", 1}, {"y", 2}},
+		Version: testVersion{1, 2},
+	}
+}
+
+func TestObjectCompatible(t *testing.T) {
+	for _, note := range []string{"", "note"} {
+		in := testObjectValue()
+		in.Note = note
+		data, err := Marshal(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mirror := testObjectMirror{}
+		if err := Unmarshal(data, &mirror); err != nil {
+			t.Fatal(err)
+		}
+		reflective, err := Marshal(&mirror)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, reflective) {
+			t.Errorf("object encoding differs:\n%x\n%x", data, reflective)
+		}
+
+		out := testObject{}
+		if err := Unmarshal(reflective, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+		}
+	}
+}
+
+func TestObjectInStruct(t *testing.T) {
+	type wrapper struct {
+		Object  testObject        `store:"object"`
+		Objects []testObjectInner `store:"objects"`
+	}
+	type mirror struct {
+		Object  testObjectMirror `store:"object"`
+		Objects []testInner      `store:"objects"`
+	}
+
+	in := wrapper{testObjectValue(), []testObjectInner{{"a", 1}}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mirror{}
+	if err := Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := Marshal(m); !bytes.Equal(data, want) {
+		t.Errorf("object encoding differs:\n%x\n%x", data, want)
+	}
+	out := wrapper{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+}
+
+func TestObjectErrors(t *testing.T) {
+	in := testObjectValue()
+	data, _ := Marshal(&in)
+
+	decode := func(change func(s *Section)) (testObject, error) {
+		s, _ := UnmarshalSection(data)
+		change(s)
+		modified, _ := MarshalSection(s)
+		out := testObject{}
+		err := Unmarshal(modified, &out)
+		return out, err
+	}
+
+	// Unknown entries are skipped, integers of any width are accepted
+	out, err := decode(func(s *Section) {
+		s.Set("extra", []string{"skipped"})
+		s.Set("i8", int64(-7))
+		s.Set("u64", uint8(9))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.I8 != -7 || out.U64 != 9 || out.Inner != in.Inner {
+		t.Errorf("unexpected decoded value %+v", out)
+	}
+
+	tests := map[string]func(s *Section){
+		"missing":  func(s *Section) { s.Delete("str") },
+		"type":     func(s *Section) { s.Set("str", uint8(1)) },
+		"array":    func(s *Section) { s.Set("ints", uint64(1)) },
+		"nested":   func(s *Section) { inner, _ := s.Section("inner"); inner.Delete("value") },
+		"overflow": func(s *Section) { s.Set("i8", int64(300)) },
+		"blob":     func(s *Section) { s.Set("hash", "abc") },
+	}
+	for name, change := range tests {
+		if _, err := decode(change); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := decode(tests["overflow"]); err != ErrOverflow {
+		t.Errorf("err = %v, want %v", err, ErrOverflow)
+	}
+	if _, err := decode(tests["blob"]); err != ErrBadBlob {
+		t.Errorf("err = %v, want %v", err, ErrBadBlob)
+	}
+
+	// Entries are unique
+	duplicated := append([]byte{}, data[:9]...)
+	duplicated = append(duplicated, 3<<2)
+	for i := 0; i < 2; i++ {
+		duplicated = append(duplicated, 5, 'v', 'a', 'l', 'u', 'e', serializeTypeUint8, 1)
+	}
+	duplicated = append(duplicated, 4, 'n', 'a', 'm', 'e', serializeTypeString, 0)
+	if err := Unmarshal(duplicated, &testObjectInner{}); err == nil {
+		t.Error("duplicated entry was accepted")
+	}
+}
@@ -0,0 +1,448 @@
+package portable
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type testInner struct {
+	Name  string `store:"name"`
+	Value uint32 `store:"value"`
+}
+
+type testAll struct {
+	I64    int64         `store:"i64"`
+	I32    int32         `store:"i32"`
+	I16    int16         `store:"i16"`
+	I8     int8          `store:"i8"`
+	U64    uint64        `store:"u64"`
+	U32    uint32        `store:"u32"`
+	U16    uint16        `store:"u16"`
+	U8     uint8         `store:"u8"`
+	F64    float64       `store:"f64"`
+	Str    string        `store:"str"`
+	Bool   bool          `store:"bool"`
+	Object testInner     `store:"object"`
+	Ints   []uint64      `store:"ints"`
+	Floats []float64     `store:"floats"`
+	Bools  []bool        `store:"bools"`
+	Strs   []string      `store:"strs"`
+	Inners []testInner   `store:"inners"`
+	Nested [][]int32     `store:"nested"`
+	Deep   [][][]string  `store:"deep"`
+	Empty  []testInner   `store:"empty"`
+	Matrix [][]testInner `store:"matrix"`
+}
+
+func testAllValue() testAll {
+	return testAll{
+		I64: -1 << 40, I32: -1 << 20, I16: -300, I8: -5,
+		U64: 1 << 62, U32: 1 << 31, U16: 60000, U8: 200,
+		F64:    3.25,
+		Str:    "hello\x00world",
+		Bool:   true,
+		Object: testInner{"inner", 7},
+		Ints:   []uint64{0, 1, 1 << 63},
+		Floats: []float64{-1.5, 2},
+		Bools:  []bool{true, false, true},
+		Strs:   []string{"a", "", "c"},
+		Inners: []testInner{{"x", 1}, {"y", 2}},
+		Nested: [][]int32{{1, 2}, {}, {-3}},
+		Deep:   [][][]string{{{"a"}, {"b", "c"}}},
+		Empty:  []testInner{},
+		Matrix: [][]testInner{{{"m", 9}}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := testAllValue()
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := testAll{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, value := range []uint64{0, 0x3f, 0x40, 0x3fff, 0x4000, 0x3fffffff, 0x40000000, 0x3fffffffffffffff} {
+		var b bytes.Buffer
+		if err := encodeVarint(newWriter(&b), value); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeVarint(newReader(&b, Limits{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != value {
+			t.Errorf("varint %x decoded as %x", value, decoded)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := encodeVarint(newWriter(&b), 0x4000000000000000); err != ErrBadVarint {
+		t.Errorf("err = %v, want %v", err, ErrBadVarint)
+	}
+}
+
+// Varints as written by epee's pack_varint. The low two bits of the first byte
+// are the size mark: 0, 1, 2 and 3 for 1, 2, 4 and 8 bytes
+func TestVarintWireFormat(t *testing.T) {
+	tests := []struct {
+		value uint64
+		data  string
+	}{
+		{0x3f, "fc"},
+		{0x40, "0101"},
+		{0x4000, "02000100"},
+		{0x40000000, "0300000001000000"},
+		{0x3fffffffffffffff, "ffffffffffffffff"},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.data)
+
+		var b bytes.Buffer
+		if err := encodeVarint(newWriter(&b), test.value); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), data) {
+			t.Errorf("varint %x encoded as %x, want %s", test.value, b.Bytes(), test.data)
+		}
+
+		decoded, err := decodeVarint(newReader(bytes.NewReader(data), Limits{}))
+		if err != nil || decoded != test.value {
+			t.Errorf("%s decoded as %x, %v", test.data, decoded, err)
+		}
+	}
+}
+
+// Arrays of arrays are stored as serializeTypeArray, every element of which
+// carries its own array type
+func TestNestedArrayWireFormat(t *testing.T) {
+	type nested struct {
+		Nested [][]uint16 `store:"nested"`
+	}
+	want, _ := hex.DecodeString("011101010101020101" + // header
+		"04" + "066e6573746564" + // 1 entry, "nested"
+		"8d" + "08" + // array of 2 arrays
+		"87" + "08" + "0100" + "0200" + // [1, 2] of uint16
+		"87" + "00") // [] of uint16
+
+	data, err := Marshal(nested{[][]uint16{{1, 2}, {}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("got %x, want %x", data, want)
+	}
+
+	decoded := nested{}
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, nested{[][]uint16{{1, 2}, {}}}) {
+		t.Errorf("got %+v", decoded)
+	}
+}
+
+func TestIntegerConversion(t *testing.T) {
+	type wide struct {
+		Value int64 `store:"value"`
+	}
+	type narrow struct {
+		Value uint8 `store:"value"`
+	}
+
+	data, _ := Marshal(wide{200})
+	n := narrow{}
+	if err := Unmarshal(data, &n); err != nil || n.Value != 200 {
+		t.Errorf("got %d, %v", n.Value, err)
+	}
+
+	data, _ = Marshal(wide{-1})
+	if err := Unmarshal(data, &n); err != ErrOverflow {
+		t.Errorf("err = %v, want %v", err, ErrOverflow)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	type str struct {
+		Value string `store:"value"`
+	}
+	type boolean struct {
+		Value bool `store:"value"`
+	}
+
+	data, _ := Marshal(str{"true"})
+	if err := Unmarshal(data, &boolean{}); err == nil {
+		t.Error("string decoded into bool")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	in := testAllValue()
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for l := 0; l < len(data); l++ {
+		if err := Unmarshal(data[:l], &testAll{}); err == nil {
+			t.Fatalf("truncated packet of %d bytes decoded without error", l)
+		}
+	}
+}
+
+func TestSkipUnknown(t *testing.T) {
+	type known struct {
+		Str string `store:"str"`
+		U8  uint8  `store:"u8"`
+	}
+
+	in := testAllValue()
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := known{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Str != in.Str || out.U8 != in.U8 {
+		t.Errorf("unexpected result: %+v", out)
+	}
+}
+
+func TestOptional(t *testing.T) {
+	type small struct {
+		A uint32 `store:"a"`
+	}
+	type big struct {
+		A uint32   `store:"a"`
+		B string   `store:"b,optional"`
+		C []uint64 `store:"c,omitempty"`
+	}
+	type required struct {
+		A uint32 `store:"a"`
+		B string `store:"b"`
+	}
+
+	data, _ := Marshal(small{5})
+	out := big{B: "untouched"}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.A != 5 || out.B != "untouched" || out.C != nil {
+		t.Errorf("unexpected result: %+v", out)
+	}
+	if err := Unmarshal(data, &required{}); err == nil {
+		t.Error("missing required entry was not reported")
+	}
+
+	// Empty C should not be written at all
+	withEmpty, _ := Marshal(big{A: 5})
+	withoutEmpty, _ := Marshal(struct {
+		A uint32 `store:"a"`
+		B string `store:"b"`
+	}{A: 5})
+	if !bytes.Equal(withEmpty, withoutEmpty) {
+		t.Errorf("omitempty field was written:\n%x\n%x", withEmpty, withoutEmpty)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	type hashes struct {
+		Hash  [32]byte `store:"hash"`
+		Key   []byte   `store:"key"`
+		Plain string   `store:"plain"`
+	}
+
+	in := hashes{Key: []byte{1, 2, 3}, Plain: "abc"}
+	in.Hash[0], in.Hash[31] = 0xaa, 0xbb
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Byte fields are strings on the wire, so they are interchangeable
+	asStrings := struct {
+		Hash  string `store:"hash"`
+		Key   string `store:"key"`
+		Plain []byte `store:"plain"`
+	}{}
+	if err := Unmarshal(data, &asStrings); err != nil {
+		t.Fatal(err)
+	}
+	if asStrings.Hash != string(in.Hash[:]) || asStrings.Key != "\x01\x02\x03" || string(asStrings.Plain) != "abc" {
+		t.Errorf("unexpected strings: %+v", asStrings)
+	}
+
+	out := hashes{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	short := struct {
+		Hash [16]byte `store:"hash"`
+	}{}
+	if err := Unmarshal(data, &short); err != ErrBadBlob {
+		t.Errorf("err = %v, want %v", err, ErrBadBlob)
+	}
+}
+
+func TestBlob(t *testing.T) {
+	type blobs struct {
+		Ids     []uint64   `store:"ids,blob"`
+		Hashes  [][32]byte `store:"hashes,blob"`
+		Indices []uint32   `store:"indices"`
+	}
+
+	in := blobs{
+		Ids:     []uint64{1, 2, 1 << 60},
+		Hashes:  [][32]byte{{1}, {2}},
+		Indices: []uint32{3},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := UnmarshalSection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, ok := s.String("ids"); !ok || len(ids) != 3*8 {
+		t.Errorf("ids are not packed: %q", ids)
+	}
+	if hashes, ok := s.String("hashes"); !ok || len(hashes) != 2*32 {
+		t.Errorf("hashes are not packed: %q", hashes)
+	}
+
+	out := blobs{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	s.Set("ids", "odd")
+	data, _ = MarshalSection(s)
+	if err := Unmarshal(data, &out); err != ErrBadBlob {
+		t.Errorf("err = %v, want %v", err, ErrBadBlob)
+	}
+}
+
+// Stored as a "major.minor" string
+type testVersion struct {
+	Major, Minor uint8
+}
+
+func (v testVersion) MarshalPortable() (Value, error) {
+	return string([]byte{'0' + v.Major, '.', '0' + v.Minor}), nil
+}
+
+func (v *testVersion) UnmarshalPortable(value Value) error {
+	s, ok := value.(string)
+	if !ok || len(s) != 3 || s[1] != '.' {
+		return ErrTypeMismatch
+	}
+	v.Major, v.Minor = s[0]-'0', s[2]-'0'
+	return nil
+}
+
+func TestMarshaler(t *testing.T) {
+	type versions struct {
+		Current testVersion     `store:"current"`
+		Known   []testVersion   `store:"known"`
+		Nested  [][]testVersion `store:"nested"`
+	}
+
+	in := versions{
+		Current: testVersion{1, 2},
+		Known:   []testVersion{{0, 1}, {0, 9}},
+		Nested:  [][]testVersion{{{3, 4}}, {}},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := UnmarshalSection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := s.String("current"); current != "1.2" {
+		t.Errorf("current = %q", current)
+	}
+	if known, _ := s.Get("known"); !reflect.DeepEqual(known, []string{"0.1", "0.9"}) {
+		t.Errorf("known = %#v", known)
+	}
+
+	out := versions{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	js, err := ToJSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `{"current":"1.2","known":["0.1","0.9"],"nested":[["3.4"],[]]}` {
+		t.Errorf("unexpected JSON: %s", js)
+	}
+	out = versions{}
+	if err := FromJSON(js, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("JSON round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	s.Set("current", uint8(12))
+	data, _ = MarshalSection(s)
+	if err := Unmarshal(data, &out); err != ErrTypeMismatch {
+		t.Errorf("err = %v, want %v", err, ErrTypeMismatch)
+	}
+}
+
+func TestDynamicBlob(t *testing.T) {
+	blob := NewSection()
+	blob.Set("data", Blob{0x00, 0xff})
+	str := NewSection()
+	str.Set("data", "\x00\xff")
+
+	data, err := MarshalSection(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := MarshalSection(str); !bytes.Equal(data, want) {
+		t.Errorf("blob is stored as %x, want %x", data, want)
+	}
+	if j, err := ToJSON(blob); err != nil || string(j) != `{"data":{"$blob":"00ff"}}` {
+		t.Errorf("blob goes to JSON as %s, %v", j, err)
+	}
+
+	for _, v := range []Value{Blob{0x00, 0xff}, "\x00\xff"} {
+		if b, err := ToBlob(v, 2); err != nil || !bytes.Equal(b, []byte{0x00, 0xff}) {
+			t.Errorf("ToBlob(%q) = %x, %v", v, b, err)
+		}
+	}
+	if _, err := ToBlob("00ff", 2); err != ErrBadBlob {
+		t.Errorf("err = %v, want %v", err, ErrBadBlob)
+	}
+}
@@ -0,0 +1,85 @@
+package portable
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Encoder output. Fixed-size values go through scratch, binary.Write would
+// allocate for every one of them
+type writer struct {
+	w       io.Writer
+	scratch [9]byte
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: w}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *writer) writeUint8(value uint8) error {
+	w.scratch[0] = value
+	_, err := w.w.Write(w.scratch[:1])
+	return err
+}
+
+// Writes size lower bytes of value
+func (w *writer) writeUint(value uint64, size int) error {
+	binary.LittleEndian.PutUint64(w.scratch[:8], value)
+	_, err := w.w.Write(w.scratch[:size])
+	return err
+}
+
+// Writes the serialize type followed by size lower bytes of value
+func (w *writer) writeTyped(valueType uint8, value uint64, size int) error {
+	w.scratch[0] = valueType
+	binary.LittleEndian.PutUint64(w.scratch[1:], value)
+	_, err := w.w.Write(w.scratch[:1+size])
+	return err
+}
+
+// Writes a string value, its length goes first
+func (w *writer) writeString(s string) error {
+	if err := encodeVarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+func (r *reader) readUint8() (uint8, error) {
+	if _, err := io.ReadFull(r, r.scratch[:1]); err != nil {
+		return 0, err
+	}
+	return r.scratch[0], nil
+}
+
+// Reads a little endian value of size bytes
+func (r *reader) readUint(size int) (uint64, error) {
+	r.scratch = [8]byte{}
+	if _, err := io.ReadFull(r, r.scratch[:size]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(r.scratch[:]), nil
+}
+
+func (r *reader) readFloat64() (float64, error) {
+	bits, err := r.readUint(8)
+	return math.Float64frombits(bits), err
+}
+
+func (r *reader) readBool() (bool, error) {
+	value, err := r.readUint8()
+	return value != 0, err
+}
+
+// Reads a little endian value of size bytes and extends its sign
+func (r *reader) readInt(size int) (int64, error) {
+	value, err := r.readUint(size)
+	shift := 64 - 8*size
+	return int64(value<<shift) >> shift, err
+}
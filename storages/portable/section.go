@@ -0,0 +1,471 @@
+package portable
+
+import (
+	"io"
+	"math"
+	"reflect"
+)
+
+// Value is anything a section entry may hold. Those are:
+//
+//	int64, int32, int16, int8, uint64, uint32, uint16, uint8, float64,
+//	string, bool and *Section
+//
+// and arrays of them as typed slices ([]uint64, []string, []*Section...).
+// Arrays of arrays are []Value with each element being a typed slice.
+// Binary strings may also be given as Blob
+type Value interface{}
+
+// Blob is a binary string entry. It is stored as a plain string, but always
+// goes to JSON as a binary string (see ToJSON). The storage decoders return
+// plain strings, FromJSON returns Blob for binary strings. Use ToBlob to read
+// such entries whichever way they were decoded
+type Blob []byte
+
+// Section is a schema-less portable storage object. It keeps the order of
+// its entries, so a decoded section is encoded back byte to byte
+type Section struct {
+	entries []entry
+	index   map[string]int // only built for sections with many entries
+}
+
+type entry struct {
+	name  string
+	value Value
+}
+
+// Sections up to this size are searched linearly, which is faster than
+// building a map for each of the many tiny objects in a message
+const sectionIndexSize = 16
+
+func NewSection() *Section {
+	return &Section{}
+}
+
+// Len returns the number of entries
+func (s *Section) Len() int {
+	return len(s.entries)
+}
+
+// Names returns entry names in order
+func (s *Section) Names() []string {
+	names := make([]string, len(s.entries))
+	for i := range s.entries {
+		names[i] = s.entries[i].name
+	}
+	return names
+}
+
+func (s *Section) Get(name string) (Value, bool) {
+	if i := s.find(name); i >= 0 {
+		return s.entries[i].value, true
+	}
+	return nil, false
+}
+
+// Set adds a new entry to the end of the section or replaces an existing one
+// in place
+func (s *Section) Set(name string, v Value) {
+	if i := s.find(name); i >= 0 {
+		s.entries[i].value = v
+		return
+	}
+	s.entries = append(s.entries, entry{name, v})
+	if s.index != nil {
+		s.index[name] = len(s.entries) - 1
+	} else if len(s.entries) > sectionIndexSize {
+		s.reindex()
+	}
+}
+
+func (s *Section) Delete(name string) {
+	i := s.find(name)
+	if i < 0 {
+		return
+	}
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	if s.index != nil {
+		s.reindex()
+	}
+}
+
+// Returns the position of entry name or -1
+func (s *Section) find(name string) int {
+	if s.index != nil {
+		if i, ok := s.index[name]; ok {
+			return i
+		}
+		return -1
+	}
+	for i := range s.entries {
+		if s.entries[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Section) reindex() {
+	s.index = make(map[string]int, len(s.entries))
+	for i := range s.entries {
+		s.index[s.entries[i].name] = i
+	}
+}
+
+// Int returns a signed integer entry of any width. Unsigned values are
+// converted if they fit
+func (s *Section) Int(name string) (int64, bool) {
+	v, _ := s.Get(name)
+	value, err := ToInt(v, 64)
+	return value, err == nil
+}
+
+// Uint returns an unsigned integer entry of any width. Signed values are
+// converted if they are not negative
+func (s *Section) Uint(name string) (uint64, bool) {
+	v, _ := s.Get(name)
+	value, err := ToUint(v, 64)
+	return value, err == nil
+}
+
+func (s *Section) Float(name string) (float64, bool) {
+	v, _ := s.Get(name)
+	value, ok := v.(float64)
+	return value, ok
+}
+
+// String returns a string entry, binary strings given as Blob included
+func (s *Section) String(name string) (string, bool) {
+	v, _ := s.Get(name)
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case Blob:
+		return string(value), true
+	}
+	return "", false
+}
+
+func (s *Section) Bool(name string) (bool, bool) {
+	v, _ := s.Get(name)
+	value, ok := v.(bool)
+	return value, ok
+}
+
+func (s *Section) Section(name string) (*Section, bool) {
+	v, _ := s.Get(name)
+	value, ok := v.(*Section)
+	return value, ok
+}
+
+func (s *Section) Sections(name string) ([]*Section, bool) {
+	v, _ := s.Get(name)
+	value, ok := v.([]*Section)
+	return value, ok
+}
+
+// UnmarshalSection decodes a whole storage without any predeclared schema
+func UnmarshalSection(data []byte) (*Section, error) {
+	s := NewSection()
+	if err := Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MarshalSection encodes s as a root of the storage
+func MarshalSection(s *Section) ([]byte, error) {
+	return Marshal(s)
+}
+
+func encodeSection(w *writer, s *Section) error {
+	if err := encodeVarint(w, uint64(len(s.entries))); err != nil {
+		return err
+	}
+	for _, e := range s.entries {
+		name := e.name
+		if len(name) > 0xff {
+			return ErrSecName
+		}
+		if err := w.writeUint8(uint8(len(name))); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w.w, name); err != nil {
+			return err
+		}
+		if err := encodeDynamic(w, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the serialize type of v followed by the value itself
+func encodeDynamic(w *writer, v Value) error {
+	switch value := v.(type) {
+	case *Section:
+		if err := w.writeUint8(serializeTypeObject); err != nil {
+			return err
+		}
+		return encodeSection(w, value)
+	case []*Section:
+		if err := w.writeUint8(serializeTypeObject | serializeArrayMask); err != nil {
+			return err
+		}
+		if err := encodeVarint(w, uint64(len(value))); err != nil {
+			return err
+		}
+		for _, s := range value {
+			if err := encodeSection(w, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []uint8:
+		// Would be a string if passed to encodeValue
+		if err := w.writeUint8(serializeTypeUint8 | serializeArrayMask); err != nil {
+			return err
+		}
+		if err := encodeVarint(w, uint64(len(value))); err != nil {
+			return err
+		}
+		_, err := w.Write(value)
+		return err
+	case []Value:
+		if err := w.writeUint8(serializeTypeArray | serializeArrayMask); err != nil {
+			return err
+		}
+		if err := encodeVarint(w, uint64(len(value))); err != nil {
+			return err
+		}
+		for _, nested := range value {
+			if !isDynamicArray(nested) {
+				return ErrBadArray
+			}
+			if err := encodeDynamic(w, nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	case int64:
+		return w.writeTyped(serializeTypeInt64, uint64(value), 8)
+	case int32:
+		return w.writeTyped(serializeTypeInt32, uint64(value), 4)
+	case int16:
+		return w.writeTyped(serializeTypeInt16, uint64(value), 2)
+	case int8:
+		return w.writeTyped(serializeTypeInt8, uint64(value), 1)
+	case uint64:
+		return w.writeTyped(serializeTypeUint64, value, 8)
+	case uint32:
+		return w.writeTyped(serializeTypeUint32, uint64(value), 4)
+	case uint16:
+		return w.writeTyped(serializeTypeUint16, uint64(value), 2)
+	case uint8:
+		return w.writeTyped(serializeTypeUint8, uint64(value), 1)
+	case float64:
+		return w.writeTyped(serializeTypeFloat64, math.Float64bits(value), 8)
+	case bool:
+		if value {
+			return w.writeTyped(serializeTypeBool, 1, 1)
+		}
+		return w.writeTyped(serializeTypeBool, 0, 1)
+	case string:
+		if err := w.writeUint8(serializeTypeString); err != nil {
+			return err
+		}
+		return w.writeString(value)
+	case Blob:
+		if err := w.writeUint8(serializeTypeString); err != nil {
+			return err
+		}
+		if err := encodeVarint(w, uint64(len(value))); err != nil {
+			return err
+		}
+		_, err := w.Write(value)
+		return err
+	case []int64, []int32, []int16, []int8, []uint64, []uint32, []uint16, []float64, []string, []bool:
+		return encodeValue(w, reflect.ValueOf(value))
+	}
+
+	return ErrUnknownType
+}
+
+func isDynamicArray(v Value) bool {
+	switch v.(type) {
+	case []*Section, []Value,
+		[]int64, []int32, []int16, []int8, []uint64, []uint32, []uint16, []uint8, []float64, []string, []bool:
+		return true
+	}
+	return false
+}
+
+func decodeSection(r *reader) (*Section, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	count, err := decodeVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.addElements(count); err != nil {
+		return nil, err
+	}
+
+	s := NewSection()
+	for i := uint64(0); i < count; i++ {
+		name, err := decodeSectionName(r)
+		if err != nil {
+			return nil, err
+		}
+		if s.find(name) >= 0 {
+			return nil, ErrEntryMissing
+		}
+		v, err := decodeDynamicEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		s.Set(name, v)
+	}
+	return s, nil
+}
+
+func decodeDynamicEntry(r *reader) (Value, error) {
+	valueType, err := r.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	if valueType&serializeArrayMask != 0 {
+		return decodeDynamicArray(r, valueType&^serializeArrayMask)
+	}
+	return decodeDynamicValue(r, valueType)
+}
+
+// Zero values for every plain serialize type, used to build typed slices
+var serializeTypeZero = map[uint8]Value{
+	serializeTypeInt64:   int64(0),
+	serializeTypeInt32:   int32(0),
+	serializeTypeInt16:   int16(0),
+	serializeTypeInt8:    int8(0),
+	serializeTypeUint64:  uint64(0),
+	serializeTypeUint32:  uint32(0),
+	serializeTypeUint16:  uint16(0),
+	serializeTypeUint8:   uint8(0),
+	serializeTypeFloat64: float64(0),
+	serializeTypeString:  "",
+	serializeTypeBool:    false,
+}
+
+func decodeDynamicArray(r *reader, valueType uint8) (Value, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	count, err := decodeVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.addArray(count, valueType); err != nil {
+		return nil, err
+	}
+
+	switch valueType {
+	case serializeTypeObject:
+		sections := make([]*Section, 0)
+		for i := uint64(0); i < count; i++ {
+			s, err := decodeSection(r)
+			if err != nil {
+				return nil, err
+			}
+			sections = append(sections, s)
+		}
+		return sections, nil
+	case serializeTypeArray:
+		arrays := make([]Value, 0)
+		for i := uint64(0); i < count; i++ {
+			nested, err := decodeDynamicValue(r, serializeTypeArray)
+			if err != nil {
+				return nil, err
+			}
+			arrays = append(arrays, nested)
+		}
+		return arrays, nil
+	}
+
+	zero, ok := serializeTypeZero[valueType]
+	if !ok {
+		return nil, ErrUnknownType
+	}
+	// Plain arrays are decoded with the reflective decoder, elements are
+	// appended one by one so a bogus count can't allocate much
+	slice := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(zero)), 0, 0)
+	elem := reflect.New(reflect.TypeOf(zero)).Elem()
+	for i := uint64(0); i < count; i++ {
+		if err := decodeValue(r, elem, valueType); err != nil {
+			return nil, err
+		}
+		slice = reflect.Append(slice, elem)
+	}
+	return slice.Interface(), nil
+}
+
+func decodeDynamicValue(r *reader, valueType uint8) (Value, error) {
+	switch valueType {
+	case serializeTypeObject:
+		return decodeSection(r)
+	case serializeTypeArray:
+		nestedType, err := r.readUint8()
+		if err != nil {
+			return nil, err
+		}
+		if nestedType&serializeArrayMask == 0 {
+			return nil, ErrBadArray
+		}
+		return decodeDynamicArray(r, nestedType&^serializeArrayMask)
+	}
+
+	switch valueType {
+	case serializeTypeInt64, serializeTypeInt32, serializeTypeInt16, serializeTypeInt8:
+		value, err := r.readInt(int(serializeTypeSize[valueType]))
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case serializeTypeInt64:
+			return value, nil
+		case serializeTypeInt32:
+			return int32(value), nil
+		case serializeTypeInt16:
+			return int16(value), nil
+		}
+		return int8(value), nil
+	case serializeTypeUint64, serializeTypeUint32, serializeTypeUint16, serializeTypeUint8:
+		value, err := r.readUint(int(serializeTypeSize[valueType]))
+		if err != nil {
+			return nil, err
+		}
+		switch valueType {
+		case serializeTypeUint64:
+			return value, nil
+		case serializeTypeUint32:
+			return uint32(value), nil
+		case serializeTypeUint16:
+			return uint16(value), nil
+		}
+		return uint8(value), nil
+	case serializeTypeFloat64:
+		return r.readFloat64()
+	case serializeTypeBool:
+		return r.readBool()
+	case serializeTypeString:
+		data, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+	return nil, ErrUnknownType
+}
@@ -0,0 +1,80 @@
+package portable
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSectionRoundTrip(t *testing.T) {
+	in := testAllValue()
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := UnmarshalSection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := MarshalSection(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, encoded) {
+		t.Errorf("section round trip mismatch:\n%x\n%x", data, encoded)
+	}
+
+	if names := s.Names(); len(names) != s.Len() || names[0] != "i64" || names[len(names)-1] != "matrix" {
+		t.Errorf("unexpected names: %v", names)
+	}
+	if v, ok := s.Int("i16"); !ok || v != -300 {
+		t.Errorf("i16 = %d, %v", v, ok)
+	}
+	if v, ok := s.Uint("u64"); !ok || v != 1<<62 {
+		t.Errorf("u64 = %d, %v", v, ok)
+	}
+	if _, ok := s.Uint("i8"); ok {
+		t.Error("negative value converted to unsigned")
+	}
+	if v, ok := s.String("str"); !ok || v != in.Str {
+		t.Errorf("str = %q, %v", v, ok)
+	}
+	if inner, ok := s.Section("object"); !ok {
+		t.Error("object is missing")
+	} else if v, _ := inner.String("name"); v != "inner" {
+		t.Errorf("object.name = %q", v)
+	}
+	if inners, ok := s.Sections("inners"); !ok || len(inners) != 2 {
+		t.Errorf("inners = %v", inners)
+	}
+	nested, _ := s.Get("nested")
+	if !reflect.DeepEqual(nested, []Value{[]int32{1, 2}, []int32{}, []int32{-3}}) {
+		t.Errorf("nested = %#v", nested)
+	}
+}
+
+func TestSectionBuild(t *testing.T) {
+	s := NewSection()
+	s.Set("name", "inner")
+	s.Set("value", uint32(7))
+	s.Set("drop", true)
+	s.Delete("drop")
+
+	data, err := MarshalSection(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := testInner{}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != (testInner{"inner", 7}) {
+		t.Errorf("unexpected result: %+v", out)
+	}
+
+	s.Set("bad", []interface{}{1})
+	if _, err := MarshalSection(s); err == nil {
+		t.Error("unsupported value was encoded")
+	}
+}
@@ -0,0 +1,121 @@
+package portable
+
+import (
+	"io"
+)
+
+// Fixed sizes of the plain serialize types
+var serializeTypeSize = map[uint8]int64{
+	serializeTypeInt64:   8,
+	serializeTypeInt32:   4,
+	serializeTypeInt16:   2,
+	serializeTypeInt8:    1,
+	serializeTypeUint64:  8,
+	serializeTypeUint32:  4,
+	serializeTypeUint16:  2,
+	serializeTypeUint8:   1,
+	serializeTypeFloat64: 8,
+	serializeTypeBool:    1,
+}
+
+// Reads and discards an entry of any type, walking its serialized layout
+func skipEntry(r *reader) error {
+	valueType, err := r.readUint8()
+	if err != nil {
+		return err
+	}
+	if valueType&serializeArrayMask != 0 {
+		return skipArray(r, valueType&^serializeArrayMask)
+	}
+	return skipValue(r, valueType)
+}
+
+func skipArray(r *reader, valueType uint8) error {
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
+
+	count, err := decodeVarint(r)
+	if err != nil {
+		return err
+	}
+	if err := r.addArray(count, valueType); err != nil {
+		return err
+	}
+	if size, ok := serializeTypeSize[valueType]; ok {
+		// Guard against overflow, the reader will run out long before
+		if count > 1<<32 {
+			return io.ErrUnexpectedEOF
+		}
+		return discard(r, int64(count)*size)
+	}
+	for i := uint64(0); i < count; i++ {
+		if err := skipValue(r, valueType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skipValue(r *reader, valueType uint8) error {
+	if size, ok := serializeTypeSize[valueType]; ok {
+		return discard(r, size)
+	}
+
+	switch valueType {
+	case serializeTypeString:
+		length, err := decodeVarint(r)
+		if err != nil {
+			return err
+		}
+		if r.limits.MaxStringLength > 0 && length > r.limits.MaxStringLength {
+			return ErrTooLong
+		}
+		return discard(r, int64(length))
+	case serializeTypeObject:
+		if err := r.enter(); err != nil {
+			return err
+		}
+		defer r.leave()
+
+		count, err := decodeVarint(r)
+		if err != nil {
+			return err
+		}
+		if err := r.addElements(count); err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := decodeSectionName(r); err != nil {
+				return err
+			}
+			if err := skipEntry(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case serializeTypeArray:
+		nestedType, err := r.readUint8()
+		if err != nil {
+			return err
+		}
+		if nestedType&serializeArrayMask == 0 {
+			return ErrBadArray
+		}
+		return skipArray(r, nestedType&^serializeArrayMask)
+	}
+
+	return ErrUnknownType
+}
+
+func discard(r io.Reader, n int64) error {
+	copied, err := io.CopyN(io.Discard, r, n)
+	if copied == n {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
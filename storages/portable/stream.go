@@ -0,0 +1,83 @@
+package portable
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder writes storages to an output stream
+type Encoder struct {
+	w     io.Writer
+	limit int64
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetLimit sets the byte budget of a single storage. Encode fails with
+// ErrTooBig instead of writing more than n bytes. Zero disables the limit,
+// which is the default
+func (e *Encoder) SetLimit(n int64) {
+	e.limit = n
+}
+
+// Encode writes the storage of v, which is either a tagged struct or a
+// *Section. The output is buffered, but on failure a part of it may already
+// be written
+func (e *Encoder) Encode(v interface{}) error {
+	b := bufio.NewWriter(e.w)
+	var w io.Writer = b
+	if e.limit > 0 {
+		w = &limitedWriter{b, e.limit}
+	}
+	if err := encode(w, v); err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+// Decoder reads storages from an input stream
+type Decoder struct {
+	r      *bufio.Reader
+	limits Limits
+}
+
+// NewDecoder returns a decoder reading from r. The decoder buffers its input,
+// so it may read more data from r than a single storage occupies. Wrap r in
+// io.LimitReader if it carries anything after the storage
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), limits: DefaultLimits}
+}
+
+// SetLimit sets the byte budget of a single storage. Decode fails with
+// ErrTooBig instead of reading more than n bytes. Zero disables the limit.
+// The default is DefaultLimits.MaxBytes
+func (d *Decoder) SetLimit(n int64) {
+	d.limits.MaxBytes = n
+}
+
+// SetLimits replaces all the limits at once
+func (d *Decoder) SetLimits(limits Limits) {
+	d.limits = limits
+}
+
+// Decode reads the next storage into v, which is either a pointer to a tagged
+// struct or a *Section
+func (d *Decoder) Decode(v interface{}) error {
+	return decode(newReader(d.r, d.limits), v)
+}
+
+// Fails with ErrTooBig once more than n bytes are written
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, ErrTooBig
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
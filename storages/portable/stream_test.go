@@ -0,0 +1,72 @@
+package portable
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	in := testAllValue()
+	s := NewSection()
+	s.Set("answer", uint64(42))
+
+	var b bytes.Buffer
+	e := NewEncoder(&b)
+	if err := e.Encode(&in); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := Marshal(&in)
+	if !bytes.HasPrefix(b.Bytes(), data) {
+		t.Error("encoder output differs from Marshal")
+	}
+
+	d := NewDecoder(&b)
+	out := testAll{}
+	if err := d.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+	outSection := NewSection()
+	if err := d.Decode(outSection); err != nil {
+		t.Fatal(err)
+	}
+	if answer, _ := outSection.Uint("answer"); answer != 42 {
+		t.Errorf("answer = %d", answer)
+	}
+	if err := d.Decode(&out); err != io.EOF {
+		t.Errorf("err = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	in := testAllValue()
+	data, _ := Marshal(&in)
+
+	e := NewEncoder(io.Discard)
+	e.SetLimit(int64(len(data)) - 1)
+	if err := e.Encode(&in); err != ErrTooBig {
+		t.Errorf("err = %v, want %v", err, ErrTooBig)
+	}
+	e.SetLimit(int64(len(data)))
+	if err := e.Encode(&in); err != nil {
+		t.Error(err)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetLimit(int64(len(data)) - 1)
+	if err := d.Decode(&testAll{}); err != ErrTooBig {
+		t.Errorf("err = %v, want %v", err, ErrTooBig)
+	}
+	d = NewDecoder(bytes.NewReader(data))
+	d.SetLimit(int64(len(data)))
+	if err := d.Decode(&testAll{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,15 +5,46 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
 )
 
+// Unmarshal decodes data into v, which is either a pointer to a tagged struct
+// or a *Section. DefaultLimits apply, use Decoder to change them
 func Unmarshal(data []byte, v interface{}) error {
-	b := bytes.NewBuffer(data)
-	return decode(b, v)
+	return decode(newReader(bytes.NewReader(data), DefaultLimits), v)
 }
 
-func decode(r io.Reader, v interface{}) error {
+func decode(r *reader, v interface{}) error {
+	if err := decodeHeader(r); err != nil {
+		return err
+	}
+	if s, ok := v.(*Section); ok {
+		decoded, err := decodeSection(r)
+		if err != nil {
+			return err
+		}
+		*s = *decoded
+		return nil
+	}
+	if u, ok := v.(ObjectUnmarshaler); ok {
+		return decodeObject(r, u)
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if u, ok := asUnmarshaler(rv); ok {
+		s, err := decodeSection(r)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalPortable(s)
+	}
+	if err := decodeStruct(r, rv); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decodeHeader(r *reader) error {
 	header := &storageHeader{}
 	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
 		return err
@@ -24,64 +55,88 @@ func decode(r io.Reader, v interface{}) error {
 	if header.Version != 1 {
 		return ErrVerMismatch
 	}
-	rv := reflect.Indirect(reflect.ValueOf(v))
-	if err := decodeStruct(r, rv); err != nil {
-		return err
-	}
 	return nil
 }
 
-func decodeStruct(r io.Reader, v reflect.Value) error {
+// Decodes a section into struct v. Entries unknown to v are skipped
+func decodeStruct(r *reader, v reflect.Value) error {
 	if v.Kind() != reflect.Struct {
 		return ErrBadRoot
 	}
 
-	t := v.Type()
-	l := v.NumField()
-	usedFields := make(map[string]struct{}) // imitate a set with zero byte structs
-	for i := 0; i < l; i++ {
-		if tag, ok := t.Field(i).Tag.Lookup("store"); ok {
-			usedFields[tag] = struct{}{}
-		}
+	info := cachedStruct(v.Type())
+	fields, byName := info.fields, info.byName
+	seen := make([]bool, len(fields))
+
+	if err := r.enter(); err != nil {
+		return err
 	}
+	defer r.leave()
 
 	c, err := decodeVarint(r)
 	if err != nil {
 		return err
-	} else if c < uint64(len(usedFields)) {
-		return ErrEntryCount
+	}
+	if err := r.addElements(c); err != nil {
+		return err
 	}
 
 	for i := uint64(0); i < c; i++ {
-		var strSize uint8
-		binary.Read(r, binary.LittleEndian, &strSize)
-		strBuf := make([]byte, strSize)
-		binary.Read(r, binary.LittleEndian, strBuf)
-		str := string(strBuf)
-		if _, prs := usedFields[str]; !prs {
-			return fmt.Errorf("%s: %s", ErrEntryMissing, str)
-		}
-		delete(usedFields, str)
-		for j := 0; j < l; j++ {
-			if tag, ok := t.Field(j).Tag.Lookup("store"); ok && tag == str {
-				if err := decodeEntry(r, v.Field(j)); err != nil {
-					return err
-				}
-				break
+		name, err := decodeSectionName(r)
+		if err != nil {
+			return err
+		}
+		j, known := byName[name]
+		if !known {
+			if err := skipEntry(r); err != nil {
+				return err
+			}
+			continue
+		}
+		if seen[j] {
+			return fmt.Errorf("%s: %s", ErrEntryMissing, name)
+		}
+		seen[j] = true
+		if fields[j].blob {
+			if err := decodeBlob(r, v.Field(fields[j].index)); err != nil {
+				return err
 			}
+		} else if err := decodeEntry(r, v.Field(fields[j].index)); err != nil {
+			return err
 		}
 	}
 
-	if len(usedFields) != 0 {
-		return ErrEntryMissing
+	for i, f := range fields {
+		if !seen[i] && !f.optional {
+			return fmt.Errorf("%s: %s", ErrEntryMissing, f.name)
+		}
 	}
 
 	return nil
 }
 
-func decodeEntry(r io.Reader, v reflect.Value) error {
-	var valueType uint8
-	if err := binary.Read(r, binary.LittleEndian, &valueType); err != nil {
+func decodeSectionName(r *reader) (string, error) {
+	size, err := r.readUint8()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, r.name[:size]); err != nil {
+		return "", err
+	}
+	return string(r.name[:size]), nil
+}
+
+func decodeEntry(r *reader, v reflect.Value) error {
+	if u, ok := asUnmarshaler(v); ok {
+		value, err := decodeDynamicEntry(r)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalPortable(value)
+	}
+
+	valueType, err := r.readUint8()
+	if err != nil {
 		return err
 	}
 	if valueType&serializeArrayMask != 0 {
@@ -90,125 +145,230 @@ func decodeEntry(r io.Reader, v reflect.Value) error {
 	return decodeValue(r, v, valueType)
 }
 
-// TODO: indexing varint on 32-bit targets
-func decodeArray(r io.Reader, v reflect.Value, valueType uint8) error {
+func decodeArray(r *reader, v reflect.Value, valueType uint8) error {
 	if v.Kind() != reflect.Slice {
 		return ErrBadArray
 	}
-	if serializeType2Kind[valueType] != v.Type().Elem().Kind() {
+	if !isUnmarshaler(v.Type().Elem()) && !isCompatible(valueType, v.Type().Elem()) {
 		return fmt.Errorf("%s: %s", ErrBadKind, v.Type().Elem().Kind())
 	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 
 	count, err := decodeVarint(r)
 	if err != nil {
 		return err
 	}
-	v.Set(reflect.MakeSlice(v.Type(), int(count), int(count)))
+	if err := r.addArray(count, valueType); err != nil {
+		return err
+	}
+
+	// Elements are appended one by one, so the slice only grows as far as
+	// the input actually goes
+	capacity := count
+	if capacity > 1024 {
+		capacity = 1024
+	}
+	slice := reflect.MakeSlice(v.Type(), 0, int(capacity))
+	elem := reflect.New(v.Type().Elem()).Elem()
+	zero := reflect.Zero(elem.Type())
 	for i := uint64(0); i < count; i++ {
-		decodeValue(r, v.Index(int(i)), valueType)
+		elem.Set(zero)
+		if err := decodeValue(r, elem, valueType); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem)
 	}
+	v.Set(slice)
 	return nil
 }
 
-func decodeValue(r io.Reader, v reflect.Value, valueType uint8) error {
+func decodeValue(r *reader, v reflect.Value, valueType uint8) error {
+	if u, ok := asObjectUnmarshaler(v); ok {
+		if valueType != serializeTypeObject {
+			return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+		}
+		return decodeObject(r, u)
+	}
+	if u, ok := asUnmarshaler(v); ok {
+		value, err := decodeDynamicValue(r, valueType)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalPortable(value)
+	}
+	if !isCompatible(valueType, v.Type()) {
+		return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+	}
+
 	switch valueType {
 	case serializeTypeObject:
 		return decodeStruct(r, v)
-	case serializeTypeString:
-		length, err := decodeVarint(r)
+	case serializeTypeArray:
+		// Nested array carries its own element type
+		nestedType, err := r.readUint8()
 		if err != nil {
 			return err
 		}
-		strBuffer := make([]byte, length)
-		if err := binary.Read(r, binary.LittleEndian, strBuffer); err != nil {
-			return err
+		if nestedType&serializeArrayMask == 0 {
+			return ErrBadArray
 		}
-		v.SetString(string(strBuffer))
-	case serializeTypeInt64:
-		var value int64
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		return decodeArray(r, v, nestedType&^serializeArrayMask)
+	case serializeTypeString:
+		strBuffer, err := r.readString()
+		if err != nil {
 			return err
 		}
-		v.SetInt(value)
-	case serializeTypeInt32:
-		var value int32
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
-			return err
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(string(strBuffer))
+		case reflect.Slice:
+			v.SetBytes(strBuffer)
+		case reflect.Array:
+			if v.Len() != len(strBuffer) {
+				return ErrBadBlob
+			}
+			reflect.Copy(v, reflect.ValueOf(strBuffer))
 		}
-		v.SetInt(int64(value))
-	case serializeTypeInt16:
-		var value int16
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+	case serializeTypeFloat64:
+		value, err := r.readFloat64()
+		if err != nil {
 			return err
 		}
-		v.SetInt(int64(value))
-	case serializeTypeInt8:
-		var value int8
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		v.SetFloat(value)
+	case serializeTypeBool:
+		value, err := r.readBool()
+		if err != nil {
 			return err
 		}
-		v.SetInt(int64(value))
-	case serializeTypeUint64:
-		var value uint64
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		v.SetBool(value)
+	case serializeTypeInt64, serializeTypeInt32, serializeTypeInt16, serializeTypeInt8:
+		value, err := r.readInt(int(serializeTypeSize[valueType]))
+		if err != nil {
 			return err
 		}
-		v.SetUint(value)
-	case serializeTypeUint32:
-		var value uint32
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
+		return setInt(v, value)
+	case serializeTypeUint64, serializeTypeUint32, serializeTypeUint16, serializeTypeUint8:
+		value, err := r.readUint(int(serializeTypeSize[valueType]))
+		if err != nil {
 			return err
 		}
-		v.SetUint(uint64(value))
-	case serializeTypeUint16:
-		var value uint16
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
-			return err
+		return setUint(v, value)
+	default:
+		return ErrUnknownType
+	}
+	return nil
+}
+
+// Reads a string entry and unpacks it into a fixed-size value or a slice of
+// those. See encodeBlob
+func decodeBlob(r *reader, v reflect.Value) error {
+	valueType, err := r.readUint8()
+	if err != nil {
+		return err
+	}
+	if valueType != serializeTypeString {
+		return fmt.Errorf("%s: %s", ErrTypeMismatch, v.Kind())
+	}
+	data, err := r.readString()
+	if err != nil {
+		return err
+	}
+
+	if v.Kind() == reflect.Slice {
+		size := binary.Size(reflect.Zero(v.Type().Elem()).Interface())
+		if size <= 0 || len(data)%size != 0 {
+			return ErrBadBlob
 		}
-		v.SetUint(uint64(value))
-	case serializeTypeUint8:
-		var value uint8
-		if err := binary.Read(r, binary.LittleEndian, &value); err != nil {
-			return err
+		slice := reflect.MakeSlice(v.Type(), len(data)/size, len(data)/size)
+		if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, slice.Interface()); err != nil {
+			return ErrBadBlob
+		}
+		v.Set(slice)
+		return nil
+	}
+
+	if binary.Size(v.Interface()) != len(data) {
+		return ErrBadBlob
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, v.Addr().Interface()); err != nil {
+		return ErrBadBlob
+	}
+	return nil
+}
+
+// Tells whether a value of valueType may be stored into a value of type t.
+// Integers of any width and signedness are interchangeable as long as the
+// value fits. Strings may also be stored into byte slices and byte arrays
+func isCompatible(valueType uint8, t reflect.Type) bool {
+	kind, ok := serializeType2Kind[valueType]
+	if !ok {
+		return false
+	}
+	if valueType == serializeTypeString && isBytes(t) {
+		return true
+	}
+	if isInteger(kind) {
+		return isInteger(t.Kind())
+	}
+	return kind == t.Kind()
+}
+
+func isInteger(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8,
+		reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		return true
+	}
+	return false
+}
+
+func setInt(v reflect.Value, value int64) error {
+	switch v.Kind() {
+	case reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
+		if v.OverflowInt(value) {
+			return ErrOverflow
+		}
+		v.SetInt(value)
+	default:
+		if value < 0 || v.OverflowUint(uint64(value)) {
+			return ErrOverflow
 		}
 		v.SetUint(uint64(value))
+	}
+	return nil
+}
+
+func setUint(v reflect.Value, value uint64) error {
+	switch v.Kind() {
+	case reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		if v.OverflowUint(value) {
+			return ErrOverflow
+		}
+		v.SetUint(value)
 	default:
-		return ErrUnknownType
+		if value > math.MaxInt64 || v.OverflowInt(int64(value)) {
+			return ErrOverflow
+		}
+		v.SetInt(int64(value))
 	}
 	return nil
 }
 
-func decodeVarint(r io.Reader) (uint64, error) {
-	buf := make([]byte, 8) // 8 bytes at most
-	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+func decodeVarint(r *reader) (uint64, error) {
+	first, err := r.readUint8()
+	if err != nil {
 		return 0, err
 	}
-	varintType := uint8(buf[0]) & 0x3
-	if varintType == portableVarint8 {
-		return uint64(buf[0]) >> 2, nil
-	} else if varintType == portableVarint16 {
-		if _, err := io.ReadFull(r, buf[1:2]); err != nil {
-			return 0, err
-		}
-		b := bytes.NewBuffer(buf[:2])
-		var value uint16
-		binary.Read(b, binary.LittleEndian, &value)
-		return uint64(value) >> 2, nil
-	} else if varintType == portableVarint32 {
-		if _, err := io.ReadFull(r, buf[1:4]); err != nil {
-			return 0, err
-		}
-		b := bytes.NewBuffer(buf[:4])
-		var value uint32
-		binary.Read(b, binary.LittleEndian, &value)
-		return uint64(value) >> 2, nil
-	} else {
-		if _, err := io.ReadFull(r, buf[1:8]); err != nil {
-			return 0, err
-		}
-		b := bytes.NewBuffer(buf[:8])
-		var value uint64
-		binary.Read(b, binary.LittleEndian, &value)
-		return value >> 2, nil
+	size := 1 << (first & 0x3) // 1, 2, 4 or 8 bytes
+	if size == 1 {
+		return uint64(first) >> 2, nil
+	}
+	rest, err := r.readUint(size - 1)
+	if err != nil {
+		return 0, err
 	}
+	return (rest<<8 | uint64(first)) >> 2, nil
 }